@@ -3,17 +3,9 @@
 import { GameClient } from "@blind-maze/client";
 import { useEffect, useRef } from "react";
 import { Player } from "@blind-maze/types";
-import { v4 } from "uuid"
+import { createClient } from "@/utils/supabase/client";
 
-const playerId: string = v4()
 const playerColor = `rgba(${Math.floor(Math.random() * 255 + 1)}, ${Math.floor(Math.random() * 255 + 1)}, ${Math.floor(Math.random() * 255 + 1)}, 1)`
-const player: Player = {
-    uuid: playerId,
-    displayName: "Player 0",
-    username: "username",
-    avatarUrl: "google.ca",
-    color: playerColor
-}
 
 interface GameContainerProps {
     playerId: string
@@ -27,10 +19,21 @@ export default function GameContainer({ playerId }: GameContainerProps) {
     let port = Number(process.env['NEXT_PUBLIC_BLIND_MAZE_SERVER_PORT']) ?? 3001
     const container = useRef<HTMLDivElement | null>(null);
     let client: GameClient | null = null
+    // The server binds the connection to the access token's user, so the
+    // player must be that user
+    const player: Player = {
+        uuid: playerId,
+        displayName: "Player 0",
+        username: "username",
+        avatarUrl: "google.ca",
+        color: playerColor
+    }
 
     useEffect(() => {
         client = new GameClient(player, container.current!, CLIENT_WIDTH_PX, CLIENT_HEIGHT_PX);
-        client.connectToServer(`ws://${ip}:${port}`)
+        createClient().auth.getSession().then(({ data }) => {
+            client?.connectToServer(`ws://${ip}:${port}`, data.session?.access_token ?? "")
+        })
         client.setVisibility(true)
 
         // TODO: Attach player identities when encountering new players, maybe in a pre-game lobby
@@ -42,6 +45,8 @@ export default function GameContainer({ playerId }: GameContainerProps) {
                 return
             }
             client.dispose()
+            // Keeps a session that resolves after unmounting from connecting
+            client = null
         }
     }, []
     )
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const DefaultMaxConnections = 1000
+const DefaultMaxConnectionsPerAddress = 8
+const DefaultMaxPlayersPerRoom = 16
+const DefaultRoomQueueSize = 0
+const DefaultMaxRooms = 64
+
+var ErrServerFull = errors.New("the server is full, try again later")
+var ErrTooManyConnections = errors.New("too many connections from your address")
+var ErrRoomFull = errors.New("the room is full, try again later")
+
+// Limits on who gets in. A limit of 0 means unlimited.
+type AdmissionConfig struct {
+	// Open WebSocket connections across the whole server
+	MaxConnections int
+	// Open WebSocket connections from one IP address
+	MaxConnectionsPerAddress int
+	// Players in one room, including disconnected players awaiting a resume
+	MaxPlayersPerRoom int
+	// Joins waiting for a place in a full room. 0 turns the queue off.
+	RoomQueueSize int
+	// Rooms open at once, including the default room. Any client can open a
+	// room by joining it, so this should stay capped in production.
+	MaxRooms int
+}
+
+func DefaultAdmissionConfig() AdmissionConfig {
+	return AdmissionConfig{
+		MaxConnections:           DefaultMaxConnections,
+		MaxConnectionsPerAddress: DefaultMaxConnectionsPerAddress,
+		MaxPlayersPerRoom:        DefaultMaxPlayersPerRoom,
+		RoomQueueSize:            DefaultRoomQueueSize,
+		MaxRooms:                 DefaultMaxRooms,
+	}
+}
+
+// Reads BLIND_MAZE_MAX_CONNECTIONS, BLIND_MAZE_MAX_CONNECTIONS_PER_IP,
+// BLIND_MAZE_MAX_PLAYERS_PER_ROOM, BLIND_MAZE_ROOM_QUEUE_SIZE and
+// BLIND_MAZE_MAX_ROOMS, keeping defaults for unset values.
+func AdmissionConfigFromEnv() (AdmissionConfig, error) {
+	config := DefaultAdmissionConfig()
+
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{
+		{"BLIND_MAZE_MAX_CONNECTIONS", &config.MaxConnections},
+		{"BLIND_MAZE_MAX_CONNECTIONS_PER_IP", &config.MaxConnectionsPerAddress},
+		{"BLIND_MAZE_MAX_PLAYERS_PER_ROOM", &config.MaxPlayersPerRoom},
+		{"BLIND_MAZE_ROOM_QUEUE_SIZE", &config.RoomQueueSize},
+		{"BLIND_MAZE_MAX_ROOMS", &config.MaxRooms},
+	} {
+		raw := os.Getenv(setting.key)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return config, fmt.Errorf("%s: %w", setting.key, err)
+		}
+		*setting.value = parsed
+	}
+
+	return config, config.Validate()
+}
+
+func (config AdmissionConfig) Validate() error {
+	if config.MaxConnections < 0 || config.MaxConnectionsPerAddress < 0 || config.MaxPlayersPerRoom < 0 || config.MaxRooms < 0 {
+		return errors.New("connection, player and room limits must not be negative")
+	}
+	if config.RoomQueueSize < 0 || config.RoomQueueSize > math.MaxUint16 {
+		return errors.New("room queue size must be between 0 and 65535")
+	}
+	return nil
+}
+
+// Counts open connections to enforce the server-wide and per-address caps.
+type Admission struct {
+	config      AdmissionConfig
+	connections int
+	perAddress  map[string]int
+	_lock       *sync.Mutex
+}
+
+func NewAdmission(config AdmissionConfig) *Admission {
+	return &Admission{
+		config:     config,
+		perAddress: map[string]int{},
+		_lock:      new(sync.Mutex),
+	}
+}
+
+// Counts a new connection from the remote address unless a cap is reached.
+// Every admitted connection must be released once it closes.
+func (admission *Admission) Admit(remoteAddress string) error {
+	address := addressHost(remoteAddress)
+
+	admission._lock.Lock()
+	defer admission._lock.Unlock()
+
+	if admission.config.MaxConnections != 0 && admission.connections >= admission.config.MaxConnections {
+		return ErrServerFull
+	}
+	if admission.config.MaxConnectionsPerAddress != 0 && admission.perAddress[address] >= admission.config.MaxConnectionsPerAddress {
+		return ErrTooManyConnections
+	}
+	admission.connections++
+	admission.perAddress[address]++
+	return nil
+}
+
+func (admission *Admission) Release(remoteAddress string) {
+	address := addressHost(remoteAddress)
+
+	admission._lock.Lock()
+	defer admission._lock.Unlock()
+
+	admission.connections--
+	admission.perAddress[address]--
+	if admission.perAddress[address] <= 0 {
+		delete(admission.perAddress, address)
+	}
+}
+
+type AdmissionStats struct {
+	Connections int
+	Addresses   int
+}
+
+func (admission *Admission) Stats() any {
+	admission._lock.Lock()
+	defer admission._lock.Unlock()
+
+	return AdmissionStats{Connections: admission.connections, Addresses: len(admission.perAddress)}
+}
+
+// Strips the port so every connection from one IP counts together.
+func addressHost(remoteAddress string) string {
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		return remoteAddress
+	}
+	return host
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/rashrasa/blind-maze/apps/go-server/types"
+)
+
+// Headroom over PLAYER_SPEED_TILES_PER_SECOND for a snapshot's velocity
+const MovementSpeedTolerance = 1.5
+
+// Distance a snapshot may cover beyond what its elapsed time allows. Clients
+// jump a little whenever they reconcile with a server snapshot.
+const MovementSlackTiles = 0.5
+
+// Distance between snapshots that counts as a teleport however much time
+// has passed
+const MovementTeleportTiles = 3.0
+
+// How far a client's timestamps may run ahead of the server's clock between
+// two snapshots
+const MovementClockSlack = 100 * time.Millisecond
+
+// Suspicion at which a player is kicked
+const SuspicionKickThreshold = 100.0
+
+// Suspicion forgiven per second
+const SuspicionDecayPerSecond = 2.0
+
+type movementViolation uint8
+
+const (
+	violationSpeed movementViolation = iota
+	violationWall
+	violationTeleport
+)
+
+var violationNames = map[movementViolation]string{
+	violationSpeed:    "speed",
+	violationWall:     "inside wall",
+	violationTeleport: "teleport",
+}
+
+var violationSuspicion = map[movementViolation]float64{
+	violationSpeed:    10,
+	violationWall:     25,
+	violationTeleport: 40,
+}
+
+// Checks the PlayerSnapshots a client sends for its player against the
+// previous one. Movement stays server-authoritative, so this only detects
+// cheating clients; their snapshots are ignored and they are snapped back.
+// Must only be used from the room's tick loop.
+type movementTracker struct {
+	previous types.PlayerSnapshot
+	received time.Time
+
+	suspicion     float64
+	lastViolation time.Time
+}
+
+// Snapshots are compared with the player's authoritative state until one has
+// been accepted.
+func newMovementTracker(player *types.PlayerSnapshot, now time.Time) *movementTracker {
+	return &movementTracker{previous: *player, received: now, lastViolation: now}
+}
+
+// Returns: every rule the snapshot breaks
+func (tracker *movementTracker) check(snapshot types.PlayerSnapshot, layout *types.MapLayout, now time.Time) []movementViolation {
+	x, y := snapshot.Position.X, snapshot.Position.Y
+	if math.IsNaN(x) || math.IsInf(x, 0) || math.IsNaN(y) || math.IsInf(y, 0) {
+		return []movementViolation{violationTeleport}
+	}
+
+	violations := []movementViolation{}
+	distance := math.Hypot(x-tracker.previous.Position.X, y-tracker.previous.Position.Y)
+	// Client timestamps are trusted only as far as the server's clock agrees
+	elapsed := time.Duration(int64(snapshot.SnapshotTimestampMs)-int64(tracker.previous.SnapshotTimestampMs)) * time.Millisecond
+	elapsed = min(max(elapsed, 0), now.Sub(tracker.received)+MovementClockSlack)
+	maxSpeed := types.PLAYER_SPEED_TILES_PER_SECOND * MovementSpeedTolerance
+
+	if distance > MovementTeleportTiles {
+		violations = append(violations, violationTeleport)
+	} else if distance > maxSpeed*elapsed.Seconds()+MovementSlackTiles ||
+		!(math.Hypot(snapshot.Velocity.X, snapshot.Velocity.Y) <= maxSpeed) {
+		violations = append(violations, violationSpeed)
+	}
+	if layout.IsWall(int(math.Floor(x)), int(math.Floor(y))) {
+		violations = append(violations, violationWall)
+	}
+	return violations
+}
+
+// Accepts the snapshot as the player's new baseline.
+func (tracker *movementTracker) accept(snapshot types.PlayerSnapshot, now time.Time) {
+	tracker.previous = snapshot
+	tracker.received = now
+}
+
+// Moves the baseline back to the player's authoritative position, keeping
+// the client's clock so the next snapshot's elapsed time is still measured.
+// Returns: the player's suspicion after adding the violations
+func (tracker *movementTracker) reject(violations []movementViolation, player *types.PlayerSnapshot, snapshot types.PlayerSnapshot, now time.Time) float64 {
+	tracker.suspicion = max(0, tracker.suspicion-now.Sub(tracker.lastViolation).Seconds()*SuspicionDecayPerSecond)
+	tracker.lastViolation = now
+	for _, violation := range violations {
+		tracker.suspicion += violationSuspicion[violation]
+	}
+
+	tracker.previous = *player
+	tracker.previous.SnapshotTimestampMs = snapshot.SnapshotTimestampMs
+	tracker.received = now
+	return tracker.suspicion
+}
+
+func describeViolations(violations []movementViolation) string {
+	description := ""
+	for i, violation := range violations {
+		if i > 0 {
+			description += ", "
+		}
+		description += violationNames[violation]
+	}
+	return description
+}
+
+// Logs a rejected snapshot and kicks the client once its suspicion is too high.
+func reportMovementViolations(connection *Connection, uuid string, violations []movementViolation, suspicion float64) {
+	log.Print("Movement violation by " + uuid + " (" + connection.address + "): " + describeViolations(violations) +
+		". Suspicion: " + fmt.Sprintf("%.0f", suspicion))
+	if suspicion >= SuspicionKickThreshold {
+		log.Print("Kicking " + uuid + " (" + connection.address + ") for repeated movement violations")
+		connection.Kick("movement violations")
+	}
+}
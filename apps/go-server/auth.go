@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("invalid access token")
+var ErrTokenExpired = errors.New("access token expired")
+
+// Claims of a Supabase access token that the server uses.
+type Claims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+	Role      string `json:"role"`
+}
+
+// Verifies Supabase access tokens locally with the project's JWT secret.
+type Auth struct {
+	secret []byte
+	// User ids allowed to spectate
+	spectators map[string]bool
+	// Lets clients without a token join under whatever uuid they claim, and
+	// anyone spectate
+	DevMode bool
+}
+
+// Reads SUPABASE_JWT_SECRET, which is required unless dev mode is on, and
+// BLIND_MAZE_SPECTATORS, a comma separated list of user ids.
+func AuthFromEnv(devMode bool) (Auth, error) {
+	auth := Auth{
+		secret:     []byte(os.Getenv("SUPABASE_JWT_SECRET")),
+		spectators: map[string]bool{},
+		DevMode:    devMode,
+	}
+	if len(auth.secret) == 0 && !auth.DevMode {
+		return auth, errors.New("SUPABASE_JWT_SECRET must be set unless BLIND_MAZE_DEV_MODE is on")
+	}
+	for _, userId := range strings.Split(os.Getenv("BLIND_MAZE_SPECTATORS"), ",") {
+		if userId = strings.TrimSpace(userId); userId != "" {
+			auth.spectators[userId] = true
+		}
+	}
+	return auth, nil
+}
+
+// Spectators see every player regardless of line of sight, so only listed
+// users may spectate outside dev mode.
+func (auth Auth) MaySpectate(userId string) bool {
+	return auth.DevMode || (userId != "" && auth.spectators[userId])
+}
+
+// Checks an HS256 access token's signature and lifetime.
+// Returns: the token's claims, which always include a subject
+func (auth Auth) Verify(token string, now time.Time) (Claims, error) {
+	if len(auth.secret) == 0 {
+		return Claims{}, ErrInvalidToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Algorithm != "HS256" {
+		return Claims{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, auth.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeTokenPart(parts[1], &claims); err != nil || claims.Subject == "" || claims.ExpiresAt == 0 {
+		return Claims{}, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func decodeTokenPart(part string, value any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, value)
+}
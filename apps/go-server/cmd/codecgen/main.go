@@ -0,0 +1,534 @@
+/*
+codecgen
+
+Generates the binary encoders and decoders shared by the Go server and the
+TypeScript client from a single schema.
+
+	go run ./cmd/codecgen -schema schema/codec.json -go types/codec_gen.go -ts ../../packages/types/codec.gen.ts
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+)
+
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// bitgrid only: names of the fields holding its dimensions
+	Width  string `json:"width"`
+	Height string `json:"height"`
+
+	// Smaller fixed point encoding used instead when quantizing
+	Quantized *Quantized `json:"quantized"`
+}
+
+type Quantized struct {
+	Type string `json:"type"`
+	// Encoded value is round(value * scale)
+	Scale float64 `json:"scale"`
+}
+
+type Struct struct {
+	Name   string  `json:"name"`
+	Doc    string  `json:"doc"`
+	Fields []Field `json:"fields"`
+}
+
+// Whether the struct also gets quantized encoders and decoders
+func (s *Struct) Quantizable() bool {
+	for _, field := range s.Fields {
+		if field.Quantized != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type Schema struct {
+	Structs []Struct `json:"structs"`
+}
+
+// Wire layout of each field type, for ENCODING comments
+var layouts = map[string]string{
+	"bool":    "bool %s 1 byte;",
+	"u8":      "u8 %s;",
+	"u16":     "u16 %s;",
+	"u32":     "u32 %s;",
+	"u64":     "u64 %s;",
+	"f64":     "f64 %s;",
+	"string":  "u32 %[1]sLength; string %[1]s;",
+	"vec2f64": "f64 %[1]s x; f64 %[1]s y;",
+	"bitgrid": "u8[height][ceil(width / 8)] %s;",
+}
+
+// Wire layout of each quantized type, for ENCODING comments
+var quantizedLayouts = map[string]string{
+	"fixedu16":     "u16 %s * %[2]g;",
+	"vec2fixedu16": "u16 %[1]s x * %[2]g; u16 %[1]s y * %[2]g;",
+	"vec2fixedi16": "i16 %[1]s x * %[2]g; i16 %[1]s y * %[2]g;",
+}
+
+// Field types each quantized type can stand in for
+var quantizedFrom = map[string]string{
+	"fixedu16":     "f64",
+	"vec2fixedu16": "vec2f64",
+	"vec2fixedi16": "vec2f64",
+}
+
+func (schema *Schema) Validate() error {
+	for _, s := range schema.Structs {
+		if s.Name == "" {
+			return fmt.Errorf("struct without a name")
+		}
+		seen := map[string]bool{}
+		for _, field := range s.Fields {
+			if _, known := layouts[field.Type]; !known {
+				return fmt.Errorf("%s.%s: unknown type %q", s.Name, field.Name, field.Type)
+			}
+			if field.Type == "bitgrid" && (!seen[field.Width] || !seen[field.Height]) {
+				return fmt.Errorf("%s.%s: width and height must name earlier fields", s.Name, field.Name)
+			}
+			if q := field.Quantized; q != nil {
+				if quantizedFrom[q.Type] != field.Type {
+					return fmt.Errorf("%s.%s: cannot quantize %s as %q", s.Name, field.Name, field.Type, q.Type)
+				}
+				if q.Scale <= 0 {
+					return fmt.Errorf("%s.%s: quantized scale must be positive", s.Name, field.Name)
+				}
+			}
+			seen[field.Name] = true
+		}
+	}
+	return nil
+}
+
+// IsLeader -> isLeader
+func tsName(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+func encodingComment(b *strings.Builder, s Struct, quantized bool) {
+	b.WriteString("// ENCODING:\n// [\n")
+	for _, field := range s.Fields {
+		if quantized && field.Quantized != nil {
+			fmt.Fprintf(b, "// "+quantizedLayouts[field.Quantized.Type]+"\n", tsName(field.Name), field.Quantized.Scale)
+			continue
+		}
+		fmt.Fprintf(b, "// "+layouts[field.Type]+"\n", tsName(field.Name))
+	}
+	b.WriteString("// ]\n")
+}
+
+func main() {
+	schemaPath := flag.String("schema", "schema/codec.json", "schema to generate from")
+	goPath := flag.String("go", "", "Go file to write")
+	tsPath := flag.String("ts", "", "TypeScript file to write")
+	goPackage := flag.String("package", "types", "package of the Go file")
+	flag.Parse()
+
+	raw, err := os.ReadFile(*schemaPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var schema Schema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		log.Fatal(*schemaPath + ": " + err.Error())
+	}
+	if err := schema.Validate(); err != nil {
+		log.Fatal(*schemaPath + ": " + err.Error())
+	}
+
+	if *goPath != "" {
+		source, err := generateGo(&schema, *goPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*goPath, source, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *tsPath != "" {
+		if err := os.WriteFile(*tsPath, generateTs(&schema), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func generateGo(schema *Schema, goPackage string) ([]byte, error) {
+	b := new(strings.Builder)
+	b.WriteString("// Code generated by codecgen from schema/codec.json. DO NOT EDIT.\n\n")
+	fmt.Fprintf(b, "package %s\n\n", goPackage)
+	usesBinary, usesMath := false, false
+	for _, s := range schema.Structs {
+		for _, field := range s.Fields {
+			switch field.Type {
+			case "u16", "u32", "u64":
+				usesBinary = true
+			case "f64", "vec2f64":
+				usesBinary, usesMath = true, true
+			}
+		}
+	}
+	b.WriteString("import (\n")
+	if usesBinary {
+		b.WriteString("\"encoding/binary\"\n")
+	}
+	if usesMath {
+		b.WriteString("\"math\"\n")
+	}
+	b.WriteString(")\n\n")
+
+	for _, s := range schema.Structs {
+		encodingComment(b, s, false)
+		fmt.Fprintf(b, "func (value *%s) ToBinary() []byte {\n", s.Name)
+		fmt.Fprintf(b, "return value.AppendBinary([]byte{})\n}\n\n")
+
+		fmt.Fprintf(b, "func (value *%s) AppendBinary(buffer []byte) []byte {\n", s.Name)
+		for _, field := range s.Fields {
+			goEncodeField(b, field, false)
+		}
+		b.WriteString("return buffer\n}\n\n")
+
+		fmt.Fprintf(b, "func %[1]sFromBinary(p []byte) (%[1]s, error) {\n", s.Name)
+		b.WriteString("decoder := NewDecoder(p)\n")
+		fmt.Fprintf(b, "value := Decode%s(decoder)\n", s.Name)
+		fmt.Fprintf(b, "if err := decoder.Finish(); err != nil {\nreturn %s{}, err\n}\n", s.Name)
+		b.WriteString("return value, nil\n}\n\n")
+
+		fmt.Fprintf(b, "// Reads a %s from the decoder, leaving any input after it.\n", s.Name)
+		fmt.Fprintf(b, "func Decode%[1]s(decoder *Decoder) %[1]s {\n", s.Name)
+		fmt.Fprintf(b, "value := %s{}\n", s.Name)
+		for _, field := range s.Fields {
+			goDecodeField(b, field, false)
+		}
+		b.WriteString("return value\n}\n\n")
+
+		if !s.Quantizable() {
+			continue
+		}
+		encodingComment(b, s, true)
+		fmt.Fprintf(b, "func (value *%s) AppendQuantized(buffer []byte) []byte {\n", s.Name)
+		for _, field := range s.Fields {
+			goEncodeField(b, field, true)
+		}
+		b.WriteString("return buffer\n}\n\n")
+
+		fmt.Fprintf(b, "// Reads a quantized %s from the decoder, leaving any input after it.\n", s.Name)
+		fmt.Fprintf(b, "func DecodeQuantized%[1]s(decoder *Decoder) %[1]s {\n", s.Name)
+		fmt.Fprintf(b, "value := %s{}\n", s.Name)
+		for _, field := range s.Fields {
+			goDecodeField(b, field, true)
+		}
+		b.WriteString("return value\n}\n\n")
+	}
+
+	return format.Source([]byte(b.String()))
+}
+
+func goEncodeField(b *strings.Builder, field Field, quantized bool) {
+	v := "value." + field.Name
+	if quantized && field.Quantized != nil {
+		scale := field.Quantized.Scale
+		switch field.Quantized.Type {
+		case "fixedu16":
+			fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint16(buffer, QuantizeUint16(%s, %g))\n", v, scale)
+		case "vec2fixedu16":
+			fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint16(buffer, QuantizeUint16(%s.X, %g))\n", v, scale)
+			fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint16(buffer, QuantizeUint16(%s.Y, %g))\n", v, scale)
+		case "vec2fixedi16":
+			fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint16(buffer, uint16(QuantizeInt16(%s.X, %g)))\n", v, scale)
+			fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint16(buffer, uint16(QuantizeInt16(%s.Y, %g)))\n", v, scale)
+		}
+		return
+	}
+	switch field.Type {
+	case "bool":
+		fmt.Fprintf(b, "if %s {\nbuffer = append(buffer, 1)\n} else {\nbuffer = append(buffer, 0)\n}\n", v)
+	case "u8":
+		fmt.Fprintf(b, "buffer = append(buffer, %s)\n", v)
+	case "u16":
+		fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint16(buffer, %s)\n", v)
+	case "u32":
+		fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint32(buffer, %s)\n", v)
+	case "u64":
+		fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint64(buffer, %s)\n", v)
+	case "f64":
+		fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(%s))\n", v)
+	case "string":
+		fmt.Fprintf(b, "buffer = append(buffer, EncodeString(%s)...)\n", v)
+	case "vec2f64":
+		fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(%s.X))\n", v)
+		fmt.Fprintf(b, "buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(%s.Y))\n", v)
+	case "bitgrid":
+		fmt.Fprintf(b, "for _, row := range %s {\nbuffer = append(buffer, row...)\n}\n", v)
+	}
+}
+
+func goDecodeField(b *strings.Builder, field Field, quantized bool) {
+	v := "value." + field.Name
+	name := tsName(field.Name)
+	if quantized && field.Quantized != nil {
+		scale := field.Quantized.Scale
+		switch field.Quantized.Type {
+		case "fixedu16":
+			fmt.Fprintf(b, "%s = float64(decoder.Uint16(%q)) / %g\n", v, name, scale)
+		case "vec2fixedu16":
+			fmt.Fprintf(b, "%s.X = float64(decoder.Uint16(%q)) / %g\n", v, name+" x", scale)
+			fmt.Fprintf(b, "%s.Y = float64(decoder.Uint16(%q)) / %g\n", v, name+" y", scale)
+		case "vec2fixedi16":
+			fmt.Fprintf(b, "%s.X = float64(int16(decoder.Uint16(%q))) / %g\n", v, name+" x", scale)
+			fmt.Fprintf(b, "%s.Y = float64(int16(decoder.Uint16(%q))) / %g\n", v, name+" y", scale)
+		}
+		return
+	}
+	switch field.Type {
+	case "bool":
+		fmt.Fprintf(b, "%s = decoder.Bool(%q)\n", v, name)
+	case "u8":
+		fmt.Fprintf(b, "%s = decoder.Uint8(%q)\n", v, name)
+	case "u16":
+		fmt.Fprintf(b, "%s = decoder.Uint16(%q)\n", v, name)
+	case "u32":
+		fmt.Fprintf(b, "%s = decoder.Uint32(%q)\n", v, name)
+	case "u64":
+		fmt.Fprintf(b, "%s = decoder.Uint64(%q)\n", v, name)
+	case "f64":
+		fmt.Fprintf(b, "%s = decoder.Float64(%q)\n", v, name)
+	case "string":
+		fmt.Fprintf(b, "%s = decoder.String(%q)\n", v, name)
+	case "vec2f64":
+		fmt.Fprintf(b, "%s.X = decoder.Float64(%q)\n", v, name+" x")
+		fmt.Fprintf(b, "%s.Y = decoder.Float64(%q)\n", v, name+" y")
+	case "bitgrid":
+		fmt.Fprintf(b, "%s = decoder.BitGrid(%q, value.%s, value.%s)\n", v, name, field.Width, field.Height)
+	}
+}
+
+func generateTs(schema *Schema) []byte {
+	b := new(strings.Builder)
+	b.WriteString("// Code generated by codecgen from apps/go-server/schema/codec.json. DO NOT EDIT.\n\n")
+	b.WriteString(tsPrelude)
+
+	for _, s := range schema.Structs {
+		fmt.Fprintf(b, "/**\n * %s\n */\n", s.Doc)
+		fmt.Fprintf(b, "export interface %s {\n", s.Name)
+		for _, field := range s.Fields {
+			tsType := map[string]string{
+				"bool":    "boolean",
+				"string":  "string",
+				"vec2f64": "{ x: number; y: number }",
+				"bitgrid": "number[][]",
+			}[field.Type]
+			if tsType == "" {
+				tsType = "number"
+			}
+			fmt.Fprintf(b, "    %s: %s;\n", tsName(field.Name), tsType)
+		}
+		b.WriteString("}\n\n")
+
+		tsCodec(b, s, false)
+		if s.Quantizable() {
+			tsCodec(b, s, true)
+		}
+	}
+
+	return []byte(strings.TrimRight(b.String(), "\n") + "\n")
+}
+
+// encodeX and decodeX, or encodeQuantizedX and decodeQuantizedX
+func tsCodec(b *strings.Builder, s Struct, quantized bool) {
+	variant := s.Name
+	if quantized {
+		variant = "Quantized" + s.Name
+	}
+
+	encodingComment(b, s, quantized)
+	fmt.Fprintf(b, "export function encode%s(writer: BinaryWriter, value: %s): void {\n", variant, s.Name)
+	for _, field := range s.Fields {
+		v := "value." + tsName(field.Name)
+		if quantized && field.Quantized != nil {
+			scale := field.Quantized.Scale
+			switch field.Quantized.Type {
+			case "fixedu16":
+				fmt.Fprintf(b, "    writer.u16(quantizeU16(%s, %g))\n", v, scale)
+			case "vec2fixedu16":
+				fmt.Fprintf(b, "    writer.u16(quantizeU16(%s.x, %g))\n    writer.u16(quantizeU16(%s.y, %g))\n", v, scale, v, scale)
+			case "vec2fixedi16":
+				fmt.Fprintf(b, "    writer.i16(quantizeI16(%s.x, %g))\n    writer.i16(quantizeI16(%s.y, %g))\n", v, scale, v, scale)
+			}
+			continue
+		}
+		switch field.Type {
+		case "bool":
+			fmt.Fprintf(b, "    writer.u8(%s ? 1 : 0)\n", v)
+		case "vec2f64":
+			fmt.Fprintf(b, "    writer.f64(%s.x)\n    writer.f64(%s.y)\n", v, v)
+		case "bitgrid":
+			fmt.Fprintf(b, "    writer.bitGrid(%s, value.%s)\n", v, tsName(field.Width))
+		default:
+			fmt.Fprintf(b, "    writer.%s(%s)\n", field.Type, v)
+		}
+	}
+	b.WriteString("}\n\n")
+
+	fmt.Fprintf(b, "export function decode%s(reader: BinaryReader): %s {\n", variant, s.Name)
+	for _, field := range s.Fields {
+		name := tsName(field.Name)
+		if quantized && field.Quantized != nil {
+			scale := field.Quantized.Scale
+			switch field.Quantized.Type {
+			case "fixedu16":
+				fmt.Fprintf(b, "    let %s = reader.u16() / %g\n", name, scale)
+			case "vec2fixedu16":
+				fmt.Fprintf(b, "    let %s = { x: reader.u16() / %g, y: reader.u16() / %g }\n", name, scale, scale)
+			case "vec2fixedi16":
+				fmt.Fprintf(b, "    let %s = { x: reader.i16() / %g, y: reader.i16() / %g }\n", name, scale, scale)
+			}
+			continue
+		}
+		switch field.Type {
+		case "bool":
+			fmt.Fprintf(b, "    let %s = reader.bool()\n", name)
+		case "vec2f64":
+			fmt.Fprintf(b, "    let %s = { x: reader.f64(), y: reader.f64() }\n", name)
+		case "bitgrid":
+			fmt.Fprintf(b, "    let %s = reader.bitGrid(%s, %s)\n", name, tsName(field.Width), tsName(field.Height))
+		default:
+			fmt.Fprintf(b, "    let %s = reader.%s()\n", name, field.Type)
+		}
+	}
+	b.WriteString("    return {\n")
+	for _, field := range s.Fields {
+		fmt.Fprintf(b, "        %s: %s,\n", tsName(field.Name), tsName(field.Name))
+	}
+	b.WriteString("    }\n}\n\n")
+}
+
+const tsPrelude = `// Fixed point value for quantized fields, clamped to the encodable range
+export function quantizeU16(value: number, scale: number): number {
+    let scaled = Math.round(value * scale)
+    return Number.isNaN(scaled) ? 0 : Math.min(Math.max(scaled, 0), 0xffff)
+}
+
+export function quantizeI16(value: number, scale: number): number {
+    let scaled = Math.round(value * scale)
+    return Number.isNaN(scaled) ? 0 : Math.min(Math.max(scaled, -0x8000), 0x7fff)
+}
+
+export class BinaryWriter {
+    private buffer: Uint8Array = new Uint8Array(64)
+    private view: DataView = new DataView(this.buffer.buffer)
+    private length: number = 0
+
+    private reserve(n: number): number {
+        if (this.length + n > this.buffer.length) {
+            let grown = new Uint8Array(Math.max(this.buffer.length * 2, this.length + n))
+            grown.set(this.buffer)
+            this.buffer = grown
+            this.view = new DataView(grown.buffer)
+        }
+        let offset = this.length
+        this.length += n
+        return offset
+    }
+
+    u8(value: number) { this.view.setUint8(this.reserve(1), value) }
+    u16(value: number) { this.view.setUint16(this.reserve(2), value) }
+    i16(value: number) { this.view.setInt16(this.reserve(2), value) }
+    u32(value: number) { this.view.setUint32(this.reserve(4), value) }
+    u64(value: number) { this.view.setBigUint64(this.reserve(8), BigInt(value)) }
+    f64(value: number) { this.view.setFloat64(this.reserve(8), value) }
+
+    bytes(value: Uint8Array) {
+        this.buffer.set(value, this.reserve(value.length))
+    }
+
+    // u32 length; string
+    string(value: string) {
+        let encoded = new TextEncoder().encode(value)
+        this.u32(encoded.length)
+        this.bytes(encoded)
+    }
+
+    // Each row is packed into ceil(width / 8) bytes, most significant bit first
+    bitGrid(rows: number[][], width: number) {
+        for (let row of rows) {
+            let packed = new Uint8Array(Math.ceil(width / 8))
+            for (let x = 0; x < width; x++) {
+                if (row[x]) packed[x >> 3] = packed[x >> 3]! | (0b1000_0000 >> (x & 7))
+            }
+            this.bytes(packed)
+        }
+    }
+
+    finish(): Uint8Array {
+        return this.buffer.slice(0, this.length)
+    }
+}
+
+export class BinaryReader {
+    private readonly view: DataView
+    private offset: number = 0
+
+    constructor(private readonly buffer: ArrayBufferLike, offset: number = 0) {
+        this.view = new DataView(buffer)
+        this.offset = offset
+    }
+
+    private take(n: number): number {
+        if (this.offset + n > this.view.byteLength) {
+            throw new RangeError("truncated input at byte " + this.offset)
+        }
+        let offset = this.offset
+        this.offset += n
+        return offset
+    }
+
+    bool(): boolean {
+        let value = this.u8()
+        if (value > 1) throw new RangeError("invalid bool at byte " + (this.offset - 1))
+        return value == 1
+    }
+    u8(): number { return this.view.getUint8(this.take(1)) }
+    u16(): number { return this.view.getUint16(this.take(2)) }
+    i16(): number { return this.view.getInt16(this.take(2)) }
+    u32(): number { return this.view.getUint32(this.take(4)) }
+    u64(): number { return Number(this.view.getBigUint64(this.take(8))) }
+    f64(): number { return this.view.getFloat64(this.take(8)) }
+
+    bytes(n: number): Uint8Array {
+        return new Uint8Array(this.buffer, this.take(n), n)
+    }
+
+    // u32 length; string
+    string(): string {
+        return new TextDecoder("utf-8").decode(this.bytes(this.u32()))
+    }
+
+    bitGrid(width: number, height: number): number[][] {
+        let rows: number[][] = []
+        for (let y = 0; y < height; y++) {
+            let packed = this.bytes(Math.ceil(width / 8))
+            let row: number[] = []
+            for (let x = 0; x < width; x++) {
+                row.push((packed[x >> 3]! >> (7 - (x & 7))) & 0b0000_0001)
+            }
+            rows.push(row)
+        }
+        return rows
+    }
+
+    remaining(): number {
+        return this.view.byteLength - this.offset
+    }
+}
+
+`
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// The committed codecs must be what go generate writes from the schema, so a
+// schema change can't ship without regenerating both languages.
+func TestGeneratedCodecsUpToDate(t *testing.T) {
+	raw, err := os.ReadFile("../../schema/codec.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema Schema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	goSource, err := generateGo(&schema, "types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, generated := range []struct {
+		path   string
+		source []byte
+	}{
+		{"../../types/codec_gen.go", goSource},
+		{"../../../../packages/types/codec.gen.ts", generateTs(&schema)},
+	} {
+		committed, err := os.ReadFile(generated.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(committed) != string(generated.source) {
+			t.Errorf("%s is out of date with the schema, run go generate ./types", generated.path)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/rashrasa/blind-maze/apps/go-server/types"
+)
+
+// Sec-WebSocket-Protocol values a client can ask for
+const BinarySubprotocol = "blind-maze.binary"
+const JSONSubprotocol = "blind-maze.json"
+
+// Turns messages into frames and back for one connection.
+type Codec interface {
+	// Sec-WebSocket-Protocol value that selects this codec
+	Subprotocol() string
+	// websocket.BinaryMessage or websocket.TextMessage
+	FrameType() int
+	Encode(message ServerMessage) ([]byte, error)
+	Decode(p []byte) (ClientMessage, error)
+}
+
+// In order of preference when a client offers several
+var Codecs = []Codec{binaryCodec{}, jsonCodec{}}
+
+// Clients that ask for no subprotocol predate codecs and speak binary.
+// Returns: nil if no codec has the subprotocol
+func CodecForSubprotocol(subprotocol string) Codec {
+	if subprotocol == "" {
+		return binaryCodec{}
+	}
+	for _, codec := range Codecs {
+		if codec.Subprotocol() == subprotocol {
+			return codec
+		}
+	}
+	return nil
+}
+
+func Subprotocols() []string {
+	subprotocols := []string{}
+	for _, codec := range Codecs {
+		subprotocols = append(subprotocols, codec.Subprotocol())
+	}
+	return subprotocols
+}
+
+// The compact big-endian format described by each message's ENCODING comment.
+type binaryCodec struct{}
+
+func (binaryCodec) Subprotocol() string { return BinarySubprotocol }
+
+func (binaryCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (binaryCodec) Encode(message ServerMessage) ([]byte, error) {
+	return message.AppendBinary([]byte{message.Type()}), nil
+}
+
+func (binaryCodec) Decode(p []byte) (ClientMessage, error) {
+	if len(p) == 0 {
+		return nil, newClientError(ErrorInvalidMessage, "empty message")
+	}
+	decoder := types.NewDecoder(p[1:])
+
+	switch p[0] {
+	case ClientHelloMessage:
+		if len(p) != 7 {
+			return nil, newClientError(ErrorInvalidMessage, "hello message must be 7 bytes")
+		}
+		return helloRequest{
+			ProtocolVersion: binary.BigEndian.Uint16(p[1:3]),
+			Features:        binary.BigEndian.Uint32(p[3:7]),
+		}, nil
+	case ClientNewConnectionMessage:
+		request := joinRequest{Uuid: decoder.String("uuid")}
+		if decoder.Err() == nil && decoder.Remaining() > 0 {
+			request.RoomId = decoder.String("roomId")
+		}
+		if decoder.Err() == nil && decoder.Remaining() > 0 {
+			request.AccessToken = decoder.String("accessToken")
+		}
+		if err := decoder.Finish(); err != nil {
+			return nil, err
+		}
+		return request, nil
+	case ClientUpdateRequestMessage:
+		snapshot, err := types.PlayerSnapshotFromBinary(p[1:])
+		if err != nil {
+			return nil, err
+		}
+		return playerUpdateRequest{Snapshot: snapshot}, nil
+	case ClientInputMessage:
+		if len(p) != 6 {
+			return nil, newClientError(ErrorInvalidMessage, "input message must be 6 bytes")
+		}
+		return inputRequest{Sequence: binary.BigEndian.Uint32(p[1:5]), Keys: p[5]}, nil
+	case ClientAckMessage:
+		if len(p) != 9 {
+			return nil, newClientError(ErrorInvalidMessage, "ack message must be 9 bytes")
+		}
+		return ackRequest{Tick: binary.BigEndian.Uint64(p[1:9])}, nil
+	case ClientReleaseParticleMessage:
+		release, err := types.ParticleReleaseFromBinary(p[1:])
+		if err != nil {
+			return nil, err
+		}
+		return releaseParticleRequest{Release: release}, nil
+	case ClientResumeMessage:
+		request := resumeRequest{Token: decoder.String("token")}
+		if err := decoder.Finish(); err != nil {
+			return nil, err
+		}
+		return request, nil
+	case ClientSpectateMessage:
+		request := spectateRequest{Follow: decoder.String("follow")}
+		if decoder.Err() == nil && decoder.Remaining() > 0 {
+			request.AccessToken = decoder.String("accessToken")
+		}
+		if err := decoder.Finish(); err != nil {
+			return nil, err
+		}
+		return request, nil
+	default:
+		return nil, newClientError(ErrorUnknownMessageType, "unknown request type received")
+	}
+}
+
+// Names used in the "type" field of JSON messages
+var serverMessageNames = map[uint8]string{
+	ServerStateMessage:        "state",
+	ServerMapMessage:          "map",
+	ServerWelcomeMessage:      "welcome",
+	ServerPlayerJoinedMessage: "playerJoined",
+	ServerPlayerLeftMessage:   "playerLeft",
+	ServerKickedMessage:       "kicked",
+	ServerErrorMessage:        "error",
+	ServerSessionMessage:      "session",
+	ServerFullMessage:         "serverFull",
+	ServerQueuedMessage:       "queued",
+	ServerSpectatingMessage:   "spectating",
+}
+
+var clientMessageTypes = map[string]uint8{
+	"hello":           ClientHelloMessage,
+	"join":            ClientNewConnectionMessage,
+	"playerUpdate":    ClientUpdateRequestMessage,
+	"input":           ClientInputMessage,
+	"ack":             ClientAckMessage,
+	"releaseParticle": ClientReleaseParticleMessage,
+	"resume":          ClientResumeMessage,
+	"spectate":        ClientSpectateMessage,
+}
+
+// Text frames holding one JSON object each, for reading traffic in browser
+// devtools. The object's "type" field names the message and the rest are its
+// fields, e.g. {"type":"input","sequence":1,"keys":8}
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return JSONSubprotocol }
+
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (jsonCodec) Encode(message ServerMessage) ([]byte, error) {
+	fields, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(serverMessageNames[message.Type()])
+	if err != nil {
+		return nil, err
+	}
+	encoded = append([]byte(`{"type":`), encoded...)
+
+	// Splices the message's own fields in after "type"
+	fields = bytes.TrimPrefix(fields, []byte("{"))
+	if !bytes.Equal(fields, []byte("}")) {
+		encoded = append(encoded, ',')
+	}
+	return append(encoded, fields...), nil
+}
+
+func (jsonCodec) Decode(p []byte) (ClientMessage, error) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(p, &envelope); err != nil {
+		return nil, newClientError(ErrorInvalidMessage, err.Error())
+	}
+	messageType, exists := clientMessageTypes[envelope.Type]
+	if !exists {
+		return nil, newClientError(ErrorUnknownMessageType, "unknown request type received")
+	}
+
+	var message ClientMessage
+	var err error
+	switch messageType {
+	case ClientHelloMessage:
+		message, err = decodeJSON[helloRequest](p)
+	case ClientNewConnectionMessage:
+		message, err = decodeJSON[joinRequest](p)
+	case ClientUpdateRequestMessage:
+		message, err = decodeJSON[playerUpdateRequest](p)
+	case ClientInputMessage:
+		message, err = decodeJSON[inputRequest](p)
+	case ClientAckMessage:
+		message, err = decodeJSON[ackRequest](p)
+	case ClientReleaseParticleMessage:
+		message, err = decodeJSON[releaseParticleRequest](p)
+	case ClientResumeMessage:
+		message, err = decodeJSON[resumeRequest](p)
+	case ClientSpectateMessage:
+		message, err = decodeJSON[spectateRequest](p)
+	}
+	if err != nil {
+		return nil, newClientError(ErrorInvalidMessage, err.Error())
+	}
+	return message, nil
+}
+
+func decodeJSON[T ClientMessage](p []byte) (T, error) {
+	var message T
+	err := json.Unmarshal(p, &message)
+	return message, err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rashrasa/blind-maze/apps/go-server/types"
+)
+
+// Something a connection wants done to a room's game state.
+// Applied by the room's tick loop between calls to GameState.Tick.
+type roomCommand interface {
+	apply(room *Room)
+}
+
+// Spawns a player for a connection and sends everyone the new state. Joins
+// to a full room wait in its queue, if it has space, or are turned away.
+// A uuid can only be played by one connection at a time; a join for a player
+// awaiting a resume takes it over instead.
+type joinCommand struct {
+	connection *Connection
+	uuid       string
+}
+
+func (command joinCommand) apply(room *Room) {
+	if room.gameState.FindPlayer(command.uuid) != nil {
+		if !room.playing(command.uuid) {
+			room.takeOverPlayer(command.connection, command.uuid)
+			return
+		}
+		log.Print("Player " + command.uuid + " is already in room " + room.Id + ". Refusing join from " + command.connection.address)
+		command.connection.QueueMessage(newErrorMessage(newClientError(ErrorAlreadyPlaying, "already playing in this room")))
+		command.connection.Close()
+		return
+	}
+	if room.spectating(command.uuid) {
+		log.Print("Player " + command.uuid + " is spectating room " + room.Id + ". Refusing join from " + command.connection.address)
+		command.connection.QueueMessage(newErrorMessage(newClientError(ErrorAlreadyPlaying, "already spectating this room")))
+		command.connection.Close()
+		return
+	}
+	if room.full() {
+		if len(room.waiting) >= room.config.QueueSize {
+			log.Print("Room " + room.Id + " is full. Turning away " + command.connection.address)
+			command.connection.TurnAway(ErrRoomFull.Error())
+			return
+		}
+		room.waiting = append(room.waiting, command)
+		command.connection.QueueMessage(queuedMessage{Position: uint16(len(room.waiting))})
+		log.Print("Room " + room.Id + " is full. Queued " + command.connection.address + " at position " + fmt.Sprint(len(room.waiting)))
+		return
+	}
+	room.spawnPlayer(command.connection, command.uuid)
+	room.issueSession(command.connection, command.uuid)
+}
+
+// Forgets a connection and removes its player, if it had one, from the game.
+type leaveCommand struct {
+	connection *Connection
+	// Leaves the player standing where it is so its session can be resumed
+	keepPlayer bool
+}
+
+func (command leaveCommand) apply(room *Room) {
+	client, exists := room.clients[command.connection]
+	delete(room.clients, command.connection)
+	for i, waiting := range room.waiting {
+		if waiting.connection == command.connection {
+			// Removes item i
+			room.waiting = append(room.waiting[:i], room.waiting[i+1:]...)
+			room.sendQueuePositions()
+			return
+		}
+	}
+	if !exists || client.uuid == "" {
+		// Never got a player, e.g. turned away from the full room
+		return
+	}
+	if !command.keepPlayer && client.sessionToken != "" {
+		// Issued after the connection had already decided not to detach
+		room.sessions.Revoke(client.sessionToken, command.connection)
+	}
+	if command.keepPlayer {
+		if room.playing(client.uuid) {
+			// Already resumed by another connection
+			return
+		}
+		if player := room.gameState.FindPlayer(client.uuid); player != nil {
+			player.InputKeys = 0
+		}
+		return
+	}
+	room.removePlayer(client.uuid)
+}
+
+// Gives a resumed session's player to its new connection. The player is
+// spawned again if it is gone, e.g. because the room was closed meanwhile.
+type resumeCommand struct {
+	connection *Connection
+	uuid       string
+	token      string
+}
+
+func (command resumeCommand) apply(room *Room) {
+	room.client(command.connection).sessionToken = command.token
+	if room.gameState.FindPlayer(command.uuid) == nil {
+		room.spawnPlayer(command.connection, command.uuid)
+		return
+	}
+	room.client(command.connection).uuid = command.uuid
+
+	log.Print("Player resumed in room " + room.Id)
+}
+
+// Makes a connection a spectator, or changes the player it follows. Unknown
+// players cannot be followed, leaving the camera free. Users with a player in
+// the room cannot also spectate it, which would show them every other player.
+type spectateCommand struct {
+	connection *Connection
+	follow     string
+}
+
+func (command spectateCommand) apply(room *Room) {
+	if userId := command.connection.userId; userId != "" && room.gameState.FindPlayer(userId) != nil {
+		log.Print("Player " + userId + " tried to spectate its own room " + room.Id + " from " + command.connection.address)
+		command.connection.QueueMessage(newErrorMessage(newClientError(ErrorAlreadyPlaying, "already playing in this room")))
+		command.connection.Close()
+		return
+	}
+	client := room.client(command.connection)
+	client.spectating = true
+	client.follow = ""
+	if command.follow != "" && room.gameState.FindPlayer(command.follow) != nil {
+		client.follow = command.follow
+	}
+	command.connection.QueueMessage(spectatingMessage{Follow: client.follow})
+}
+
+// Removes the player of a session that was not resumed in time.
+type expireSessionCommand struct {
+	uuid string
+}
+
+func (command expireSessionCommand) apply(room *Room) {
+	if room.playing(command.uuid) {
+		// Taken over by a join as the session expired
+		return
+	}
+	room.removePlayer(command.uuid)
+}
+
+// Sets the directional keys a connection's player is holding.
+type inputCommand struct {
+	connection *Connection
+	sequence   uint32
+	keys       uint8
+}
+
+func (command inputCommand) apply(room *Room) {
+	if player := room.playerOf(command.connection); player != nil {
+		player.ApplyInput(command.sequence, command.keys)
+	}
+}
+
+// Player update from a client that sends whole PlayerSnapshots. Only the
+// velocity's direction is used; position stays server-authoritative.
+// Snapshots that break the movement rules are ignored and the client is sent
+// a keyframe to snap it back to the player's real position.
+type snapshotUpdateCommand struct {
+	connection *Connection
+	snapshot   types.PlayerSnapshot
+}
+
+func (command snapshotUpdateCommand) apply(room *Room) {
+	player := room.playerOf(command.connection)
+	if player == nil {
+		return
+	}
+	now := time.Now()
+	tracker, exists := room.movement[player.Uuid]
+	if !exists {
+		tracker = newMovementTracker(player, now)
+		room.movement[player.Uuid] = tracker
+	}
+
+	violations := tracker.check(command.snapshot, &room.gameState.MapLayout, now)
+	if len(violations) > 0 {
+		suspicion := tracker.reject(violations, player, command.snapshot, now)
+		player.InputKeys = 0
+		// Deltas would leave out a player that has not moved
+		client := room.client(command.connection)
+		client.ackedTick = 0
+		client.keyframeAfterTick = room.gameState.TickNumber
+		reportMovementViolations(command.connection, player.Uuid, violations, suspicion)
+		return
+	}
+	tracker.accept(command.snapshot, now)
+	player.InputKeys = types.InputFromVelocity(command.snapshot.Velocity)
+}
+
+// Most particles alive in a room at once. Releases past this are dropped.
+const RoomMaxParticles = 1024
+
+// Adds a particle released by a client at its player's position.
+type releaseParticleCommand struct {
+	connection *Connection
+	release    types.ParticleRelease
+}
+
+func (command releaseParticleCommand) apply(room *Room) {
+	if len(room.gameState.Particles) >= RoomMaxParticles {
+		return
+	}
+	player := room.playerOf(command.connection)
+	if player == nil {
+		return
+	}
+	particle := command.release.ToParticle(player.Uuid, player.Position)
+	room.gameState.AddParticle(&particle)
+}
+
+// Records the newest snapshot tick a client has received. Acks for snapshots
+// sent before the client was last snapped back are ignored.
+type ackCommand struct {
+	connection *Connection
+	tick       uint64
+}
+
+func (command ackCommand) apply(room *Room) {
+	client := room.client(command.connection)
+	if command.tick > max(client.ackedTick, client.keyframeAfterTick) && command.tick <= room.gameState.TickNumber {
+		client.ackedTick = command.tick
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Discrete messages that may wait to be written before a client is evicted
+const ConnectionSendQueueSize = 64
+
+// Longest a single frame write may block
+const ConnectionWriteTimeout = 5 * time.Second
+
+// Longest a client may go without catching up to the latest snapshot
+const ConnectionMaxSnapshotLag = 2 * time.Second
+
+// How often the server pings each client
+const ConnectionPingInterval = 5 * time.Second
+
+// Longest a client may go without sending a message or answering a ping.
+// Half-open connections are dropped once this passes.
+const ConnectionReadTimeout = 3 * ConnectionPingInterval
+
+// A client socket. Writes are queued and performed by a dedicated writer
+// goroutine so a stalled client never blocks its room's tick loop.
+type Connection struct {
+	address     string
+	uuid        string
+	room        *Room
+	_connection *websocket.Conn
+	// Chosen by the WebSocket subprotocol
+	codec Codec
+
+	// Empty unless the client negotiated FeatureSessionResume and joined.
+	// Guarded by _lock because the room's tick loop issues it.
+	sessionToken string
+	// Subject of the client's verified access token, empty if it gave none
+	userId string
+	// Watching the room instead of playing. Spectators never get a uuid.
+	spectating bool
+
+	limiter *RateLimiter
+	// Messages dropped by the limiter
+	throttled atomic.Uint64
+	// Removed for misbehaving. Its player is removed and cannot be resumed.
+	kicked atomic.Bool
+
+	// Set by the handshake. 0 until the first message arrives. Guarded by
+	// _lock because the room's tick loop encodes snapshots with the features.
+	protocolVersion uint16
+	features        uint32
+
+	// Ping payloads are times since this, which is monotonic
+	created time.Time
+	// Smoothed round trip time in nanoseconds, 0 until the first pong
+	rtt atomic.Int64
+
+	// Discrete frames, written in order
+	outbound chan []byte
+
+	// Latest snapshot not yet written. Newer snapshots replace it.
+	_lock           *sync.Mutex
+	snapshot        []byte
+	snapshotPending time.Time
+	_snapshotReady  chan struct{}
+
+	closeCode   int
+	closeReason string
+	_stop       chan struct{}
+	_stopOnce   *sync.Once
+	_done       chan struct{}
+}
+
+func NewConnection(conn *websocket.Conn, codec Codec) *Connection {
+	connection := &Connection{
+		address:        conn.RemoteAddr().String(),
+		_connection:    conn,
+		codec:          codec,
+		created:        time.Now(),
+		limiter:        NewRateLimiter(DefaultRateLimits(), DefaultConnectionRateLimit),
+		outbound:       make(chan []byte, ConnectionSendQueueSize),
+		_lock:          new(sync.Mutex),
+		_snapshotReady: make(chan struct{}, 1),
+		_stop:          make(chan struct{}),
+		_stopOnce:      new(sync.Once),
+		_done:          make(chan struct{}),
+	}
+	conn.SetReadLimit(ConnectionMaxFrameBytes)
+	conn.SetReadDeadline(time.Now().Add(ConnectionReadTimeout))
+	conn.SetPongHandler(connection.handlePong)
+	go connection.writeLoop()
+
+	return connection
+}
+
+// Pushes back the read deadline. Called whenever the client is heard from.
+func (c *Connection) ExtendReadDeadline() {
+	c._connection.SetReadDeadline(time.Now().Add(ConnectionReadTimeout))
+}
+
+// Called by the reader goroutine with the payload of one of our pings.
+func (c *Connection) handlePong(payload string) error {
+	c.ExtendReadDeadline()
+	if len(payload) != 8 {
+		return nil
+	}
+	sent := time.Duration(binary.BigEndian.Uint64([]byte(payload)))
+	sample := time.Since(c.created) - sent
+	if sample < 0 || sample > ConnectionReadTimeout {
+		// Not a ping we sent
+		return nil
+	}
+
+	// Exponential moving average, as TCP does
+	smoothed := c.rtt.Load()
+	if smoothed == 0 {
+		smoothed = int64(sample)
+	} else {
+		smoothed += (int64(sample) - smoothed) / 8
+	}
+	c.rtt.Store(max(smoothed, 1))
+	return nil
+}
+
+// Smoothed round trip time. 0 until the client has answered a ping.
+func (c *Connection) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+func (c *Connection) ping() error {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(time.Since(c.created)))
+	return c._connection.WriteControl(websocket.PingMessage, payload, time.Now().Add(ConnectionWriteTimeout))
+}
+
+// Records the outcome of the handshake and queues the welcome. Snapshots
+// encoded with the old features are dropped so none reach the client after
+// its welcome.
+func (c *Connection) Negotiate(version uint16, features uint32) {
+	c._lock.Lock()
+	defer c._lock.Unlock()
+
+	c.protocolVersion = version
+	c.features = features
+	c.snapshot = nil
+	c.QueueMessage(welcomeMessage{ProtocolVersion: version, Features: features})
+}
+
+// Returns: the negotiated protocol version, 0 before the first message
+func (c *Connection) ProtocolVersion() uint16 {
+	c._lock.Lock()
+	defer c._lock.Unlock()
+
+	return c.protocolVersion
+}
+
+func (c *Connection) Features() uint32 {
+	c._lock.Lock()
+	defer c._lock.Unlock()
+
+	return c.features
+}
+
+func (c *Connection) SessionToken() string {
+	c._lock.Lock()
+	defer c._lock.Unlock()
+
+	return c.sessionToken
+}
+
+func (c *Connection) setSessionToken(token string) {
+	c._lock.Lock()
+	defer c._lock.Unlock()
+
+	c.sessionToken = token
+}
+
+func (c *Connection) Supports(feature uint32) bool {
+	return c.Features()&feature == feature
+}
+
+// Encodes a message with the connection's codec.
+func (c *Connection) Encode(message ServerMessage) ([]byte, error) {
+	return c.codec.Encode(message)
+}
+
+// Queues a message that must not be dropped. Messages that cannot be encoded
+// are logged and dropped.
+func (c *Connection) QueueMessage(message ServerMessage) {
+	frame, err := c.Encode(message)
+	if err != nil {
+		log.Print("Could not encode message for " + c.address + ". Error: " + err.Error())
+		return
+	}
+	c.QueueFrame(frame)
+}
+
+// Queues a frame already encoded with the connection's codec. Evicts the
+// client if it has fallen so far behind that the queue is full.
+func (c *Connection) QueueFrame(frame []byte) {
+	select {
+	case c.outbound <- frame:
+	case <-c._stop:
+	default:
+		c.CloseWithReason(websocket.ClosePolicyViolation, "send queue full")
+	}
+}
+
+// Queues an encoded snapshot, replacing any older one that has not been written yet.
+// Snapshots encoded with features other than the connection's current ones
+// are stale and dropped.
+// Evicts the client if it has not caught up for ConnectionMaxSnapshotLag.
+func (c *Connection) QueueSnapshot(data []byte, features uint32) {
+	c._lock.Lock()
+	if c.features != features {
+		c._lock.Unlock()
+		return
+	}
+	if c.snapshot == nil {
+		c.snapshotPending = time.Now()
+	}
+	c.snapshot = data
+	lag := time.Since(c.snapshotPending)
+	c._lock.Unlock()
+
+	if lag > ConnectionMaxSnapshotLag {
+		c.CloseWithReason(websocket.ClosePolicyViolation, "client too slow")
+		return
+	}
+
+	select {
+	case c._snapshotReady <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Connection) takeSnapshot() []byte {
+	c._lock.Lock()
+	defer c._lock.Unlock()
+
+	snapshot := c.snapshot
+	c.snapshot = nil
+	return snapshot
+}
+
+func (c *Connection) write(frame []byte) error {
+	c._connection.SetWriteDeadline(time.Now().Add(ConnectionWriteTimeout))
+	return c._connection.WriteMessage(c.codec.FrameType(), frame)
+}
+
+// Writes a frame, closing the connection if it fails.
+func (c *Connection) send(frame []byte) bool {
+	if err := c.write(frame); err != nil {
+		log.Print("Could not write to " + c.address + ". Error: " + err.Error())
+		c.CloseWithReason(websocket.CloseGoingAway, "write failed")
+		return false
+	}
+	return true
+}
+
+// Writes every discrete frame queued so far.
+func (c *Connection) sendQueued() bool {
+	for {
+		select {
+		case frame := <-c.outbound:
+			if !c.send(frame) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+func (c *Connection) writeLoop() {
+	defer close(c._done)
+	defer c._connection.Close()
+
+	pingTicker := time.NewTicker(ConnectionPingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		// Discrete messages go out before snapshots
+		select {
+		case frame := <-c.outbound:
+			if !c.send(frame) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case <-c._stop:
+			c.flush()
+			return
+		case frame := <-c.outbound:
+			if !c.send(frame) {
+				return
+			}
+		case <-pingTicker.C:
+			if err := c.ping(); err != nil {
+				log.Print("Could not ping " + c.address + ". Error: " + err.Error())
+				c.CloseWithReason(websocket.CloseGoingAway, "ping failed")
+				return
+			}
+		case <-c._snapshotReady:
+			// A welcome queued together with the snapshot must go first
+			if !c.sendQueued() {
+				return
+			}
+			snapshot := c.takeSnapshot()
+			if snapshot == nil {
+				continue
+			}
+			if !c.send(snapshot) {
+				return
+			}
+		}
+	}
+}
+
+// Writes whatever discrete messages are still queued, then the close frame.
+func (c *Connection) flush() {
+	for {
+		select {
+		case frame := <-c.outbound:
+			if err := c.write(frame); err != nil {
+				return
+			}
+		default:
+			c._connection.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeReason),
+				time.Now().Add(ConnectionWriteTimeout),
+			)
+			return
+		}
+	}
+}
+
+// Disconnects the client once queued messages have been written.
+// Only the first call's code and reason are sent.
+func (c *Connection) CloseWithReason(code int, reason string) {
+	c._stopOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		if code != websocket.CloseNormalClosure {
+			log.Print("Disconnecting " + c.address + ". Reason: " + reason)
+		}
+		close(c._stop)
+	})
+}
+
+// Close code sent along with a ServerKickedMessage
+const CloseKicked = 4000
+
+// Removes a misbehaving client. Its session is revoked once it disconnects.
+func (c *Connection) Kick(reason string) {
+	c.kicked.Store(true)
+	c.Evict(reason)
+}
+
+// Tells the client why it is being removed, then disconnects it. Unlike a
+// kick, its player may still be resumed.
+func (c *Connection) Evict(reason string) {
+	c.QueueMessage(kickedMessage{Reason: reason})
+	c.CloseWithReason(CloseKicked, reason)
+}
+
+func (c *Connection) Kicked() bool {
+	return c.kicked.Load()
+}
+
+// Tells the client the server or room is full, then disconnects it.
+func (c *Connection) TurnAway(reason string) {
+	c.QueueMessage(serverFullMessage{Reason: reason})
+	c.CloseWithReason(CloseServerFull, reason)
+}
+
+func (c *Connection) Close() {
+	c.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+// Blocks until the writer goroutine has exited and the socket is closed.
+func (c *Connection) Wait() {
+	<-c._done
+}
@@ -2,130 +2,340 @@ package main
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
-	"github.com/rashrasa/blind-maze/apps/go-server/generation"
 	"github.com/rashrasa/blind-maze/apps/go-server/types"
 )
 
 /*
 @blind-maze/go-server
 
-Hosts a single instance of Blind Maze
+Hosts any number of Blind Maze rooms
 */
 
-const ClientNewConnectionMessage uint8 = 0
-const ClientUpdateRequestMessage uint8 = 1
-const ClientReleaseParticleMessage uint8 = 2
-
 // Types
 type WebsocketHandler struct {
-	upgrader websocket.Upgrader
-}
-
-type Connection struct {
-	address     string
-	uuid        string
-	_connection *websocket.Conn
-	_lock       *sync.RWMutex
+	upgrader  websocket.Upgrader
+	rooms     *RoomRegistry
+	auth      Auth
+	admission *Admission
 }
 
-func (c Connection) WriteMessage(messageType int, data []byte) {
-	c._lock.Lock()
-	defer c._lock.Unlock()
+// Decodes a frame with the connection's codec and handles the message.
+func (wsh WebsocketHandler) HandleFrame(p []byte, connection *Connection) error {
+	message, err := connection.codec.Decode(p)
+	if err != nil {
+		return err
+	}
 
-	c._connection.WriteMessage(messageType, data)
+	verdict := connection.limiter.Check(message.Type(), time.Now())
+	if verdict != rateAllow {
+		connection.throttled.Add(1)
+		rateLimitDrops.Add(1)
+	}
+	switch verdict {
+	case rateDrop:
+		return nil
+	case rateWarn:
+		log.Print("Throttling " + connection.address + " (" + connection.uuid + ")")
+		connection.QueueMessage(newErrorMessage(newClientError(ErrorRateLimited, "too many messages, slow down")))
+		return nil
+	case rateKick:
+		rateLimitKicks.Add(1)
+		connection.Kick("rate limit exceeded")
+		return newClientError(ErrorRateLimited, "rate limit exceeded")
+	}
+	return wsh.HandleMessage(message, connection)
 }
 
-func HandleBinaryMessage(p []byte, address string) error {
-	messageType := p[0]
-	switch messageType {
-	case ClientNewConnectionMessage:
-		log.Print("Received new player join request")
-		// ENCODING:
-		// bytes[0:1] = message type
-		// bytes[1:] = Player object
-		uuid, _ := types.DecodeString(p[1:])
+func (wsh WebsocketHandler) HandleMessage(message ClientMessage, connection *Connection) error {
+	if hello, isHello := message.(helloRequest); isHello {
+		if connection.ProtocolVersion() != 0 {
+			return newClientError(ErrorInvalidMessage, "hello must be the first message")
+		}
+		version, features, err := negotiate(hello.ProtocolVersion, hello.Features)
+		if err != nil {
+			return err
+		}
+		connection.Negotiate(version, features)
+		log.Printf("Handshake with %s: protocol %d, features %b", connection.address, version, features)
+		return nil
+	}
+	if connection.ProtocolVersion() == 0 {
+		return newClientError(ErrorIncompatibleProtocol, "expected a hello before any other message")
+	}
 
-		log.Print("Parsed player")
-		log.Print(uuid)
-		gameState.PlayerStates = append(gameState.PlayerStates, &types.PlayerSnapshot{
-			Uuid:                uuid,
-			Position:            types.Vector2[float64]{X: 1.8, Y: 1.8},
-			Velocity:            types.Vector2[float64]{X: 0, Y: 0},
-			IsLeader:            false,
-			SnapshotTimestampMs: uint64(time.Now().UnixMilli()),
-		})
-		c := 0
-		for _, connection := range activeConnections {
-			if connection.address == address {
-				connection.uuid = uuid
+	switch message := message.(type) {
+	case joinRequest:
+		log.Print("Received new player join request")
+		if connection.uuid != "" {
+			return newClientError(ErrorInvalidMessage, "already joined")
+		}
+		if connection.spectating {
+			return newClientError(ErrorInvalidMessage, "spectators cannot join")
+		}
+		if message.AccessToken != "" {
+			if err := wsh.authenticate(connection, message.AccessToken); err != nil {
+				return err
 			}
-			message := gameState.ToBinary()
-			connection.WriteMessage(websocket.BinaryMessage, message)
-			c++
-			log.Print("Sent new player message to client. Size: " + fmt.Sprint(len(message)) + " bytes.")
-			log.Print("Active connections: ")
-			for _, connection := range activeConnections {
-				log.Print(connection)
+		}
+		if connection.userId != "" {
+			if message.Uuid != "" && message.Uuid != connection.userId {
+				return newClientError(ErrorUnauthorized, "uuid does not match the access token")
+			}
+			message.Uuid = connection.userId
+		} else if !wsh.auth.DevMode {
+			return newClientError(ErrorUnauthorized, "access token required")
+		}
+		if message.Uuid == "" {
+			return newClientError(ErrorInvalidMessage, "uuid must not be empty")
+		}
+		if message.RoomId != "" && message.RoomId != connection.room.Id {
+			if err := wsh.moveConnection(connection, message.RoomId); err != nil {
+				return newClientError(ErrorRoomUnavailable, err.Error())
 			}
-
 		}
 
-	case ClientUpdateRequestMessage:
-		// ENCODING:
-		// bytes[0:1] = message type
-		// bytes[1:] = playerSnapshot,
-
-		newPlayerSnapshot, err := types.PlayerSnapshotFromBinary(p[1:])
-		if err != nil {
-			log.Print("Could not parse player snapshot from message. " + err.Error())
-			return err
+		log.Print("Parsed player")
+		log.Print(message.Uuid)
+		connection.uuid = message.Uuid
+		// The tick loop issues the session token once the player is admitted
+		connection.room.Send(joinCommand{connection: connection, uuid: message.Uuid})
+	case resumeRequest:
+		if !connection.Supports(FeatureSessionResume) {
+			return newClientError(ErrorInvalidMessage, "session resume was not negotiated")
+		}
+		if connection.uuid != "" {
+			return newClientError(ErrorInvalidMessage, "already joined")
+		}
+		if connection.spectating {
+			return newClientError(ErrorInvalidMessage, "spectators cannot resume a player")
+		}
+		if connection.userId == "" && !wsh.auth.DevMode {
+			return newClientError(ErrorUnauthorized, "access token required")
+		}
+		session, previous, claimed := wsh.rooms.sessions.Claim(message.Token, connection.userId, connection)
+		if !claimed {
+			return newClientError(ErrorSessionExpired, "unknown or expired session")
+		}
+		if previous != nil {
+			previous.Evict("session resumed elsewhere")
+		}
+		if session.RoomId != connection.room.Id {
+			if err := wsh.moveConnection(connection, session.RoomId); err != nil {
+				return newClientError(ErrorRoomUnavailable, err.Error())
+			}
 		}
 
-		for i, playerSnapshotItem := range gameState.PlayerStates {
-			if strings.Trim(playerSnapshotItem.Uuid, "\n") == strings.Trim(newPlayerSnapshot.Uuid, "\n") {
-				gameState.PlayerStates[i] = &newPlayerSnapshot
-				break
+		connection.uuid = session.Uuid
+		connection.setSessionToken(session.Token)
+		connection.room.Send(resumeCommand{connection: connection, uuid: session.Uuid, token: session.Token})
+		connection.QueueMessage(sessionMessage{
+			Token:         session.Token,
+			GracePeriodMs: uint32(SessionGracePeriod.Milliseconds()),
+		})
+		log.Print("Resumed session of player " + session.Uuid + " for " + connection.address)
+	case spectateRequest:
+		if connection.uuid != "" {
+			return newClientError(ErrorInvalidMessage, "players cannot spectate")
+		}
+		if !connection.spectating {
+			if message.AccessToken != "" {
+				if err := wsh.authenticate(connection, message.AccessToken); err != nil {
+					return err
+				}
+			}
+			if !wsh.auth.MaySpectate(connection.userId) {
+				return newClientError(ErrorUnauthorized, "not allowed to spectate")
 			}
+			connection.spectating = true
+			log.Print(connection.address + " is spectating room " + connection.room.Id)
+		}
+		connection.room.Send(spectateCommand{connection: connection, follow: message.Follow})
+	case playerUpdateRequest:
+		if connection.uuid == "" {
+			return newClientError(ErrorNotJoined, "received player update before joining")
 		}
-		for _, connection := range activeConnections {
-			message := gameState.ToBinary()
-			connection.WriteMessage(websocket.BinaryMessage, message)
+		connection.room.Send(snapshotUpdateCommand{connection: connection, snapshot: message.Snapshot})
+	case inputRequest:
+		if connection.uuid == "" {
+			return newClientError(ErrorNotJoined, "received input before joining")
+		}
+		connection.room.Send(inputCommand{
+			connection: connection,
+			sequence:   message.Sequence,
+			keys:       message.Keys,
+		})
+	case ackRequest:
+		if !connection.Supports(FeatureDeltaSnapshots) {
+			// Without deltas every snapshot is a keyframe
+			return nil
 		}
-	case ClientReleaseParticleMessage:
-		particle := types.ParticleFromBinary(p[1:])
-		gameState.Particles = append(gameState.Particles, &particle)
+		connection.room.Send(ackCommand{connection: connection, tick: message.Tick})
+	case releaseParticleRequest:
+		if connection.uuid == "" {
+			return newClientError(ErrorNotJoined, "received particle before joining")
+		}
+		if err := message.Release.Validate(); err != nil {
+			return newClientError(ErrorInvalidMessage, err.Error())
+		}
+		connection.room.Send(releaseParticleCommand{connection: connection, release: message.Release})
 	default:
-		return errors.New("unknown request type received")
+		return newClientError(ErrorUnknownMessageType, "unknown request type received")
+	}
+
+	return nil
+}
+
+// Handles one frame, turning a panic into an error that disconnects the
+// client instead of the whole server going down.
+func (wsh WebsocketHandler) handleFrameRecovering(p []byte, connection *Connection) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case runtime.Error:
+				log.Print("Could not handle request properly. " + r.Error() + "\n")
+			default:
+				log.Print(r)
+			}
+			err = newClientError(ErrorInvalidMessage, "could not handle message")
+		}
+	}()
+	return wsh.HandleFrame(p, connection)
+}
+
+// Binds the connection to the subject of a verified access token.
+func (wsh WebsocketHandler) authenticate(connection *Connection, token string) error {
+	claims, err := wsh.auth.Verify(token, time.Now())
+	if err != nil {
+		return newClientError(ErrorUnauthorized, err.Error())
+	}
+	connection.userId = claims.Subject
+	return nil
+}
+
+// Takes a disconnected connection out of its room. Its player is kept for a
+// resume unless the connection was kicked.
+func (wsh WebsocketHandler) leaveRoom(connection *Connection) {
+	room := connection.room
+	var remaining int
+	token := connection.SessionToken()
+	if connection.Kicked() && token != "" {
+		wsh.rooms.sessions.Revoke(token, connection)
+		remaining = room.RemoveConnection(connection)
+	} else if token != "" && wsh.rooms.sessions.Detach(token, connection) {
+		remaining = room.DetachConnection(connection)
+	} else {
+		remaining = room.RemoveConnection(connection)
 	}
+	wsh.rooms.CloseIfEmpty(room.Id)
+
+	log.Print("Active connections in room " + room.Id + ": " + fmt.Sprint(remaining))
+}
 
+// Moves a connection that has not joined as a player yet into another room.
+func (wsh WebsocketHandler) moveConnection(connection *Connection, roomId string) error {
+	if connection.uuid != "" {
+		return errors.New("cannot change rooms after joining")
+	}
+	if err := ValidateRoomId(roomId); err != nil {
+		return err
+	}
+	previous := connection.room
+	if _, err := wsh.rooms.Join(roomId, connection); err != nil {
+		return err
+	}
+	previous.RemoveConnection(connection)
+	wsh.rooms.CloseIfEmpty(previous.Id)
+
+	log.Print("Moved " + connection.address + " from room " + previous.Id + " to room " + roomId)
 	return nil
 }
 
-func CheckOrigin(request *http.Request) bool {
-	//TODO: actually check origin properly
-	return true
+// Reads BLIND_MAZE_DEV_MODE, which relaxes authentication and origin checks
+// for local play.
+func DevModeFromEnv() (bool, error) {
+	raw := os.Getenv("BLIND_MAZE_DEV_MODE")
+	if raw == "" {
+		return false, nil
+	}
+	devMode, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, errors.New("BLIND_MAZE_DEV_MODE must be a boolean")
+	}
+	return devMode, nil
+}
+
+// Room id from /rooms/{roomId}, then ?room=, then the default room.
+func roomIdFromRequest(r *http.Request) string {
+	if roomId := r.PathValue("roomId"); roomId != "" {
+		return roomId
+	}
+	if roomId := r.URL.Query().Get("room"); roomId != "" {
+		return roomId
+	}
+	return DefaultRoomId
 }
 
 func (wsh WebsocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	roomId := roomIdFromRequest(r)
+	if err := ValidateRoomId(roomId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Browsers cannot set headers on WebSocket requests, so the token may
+	// come as a query parameter instead of in the join message
+	var claims Claims
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		var err error
+		claims, err = wsh.auth.Verify(token, time.Now())
+		if err != nil {
+			log.Print("Rejected access token from " + r.RemoteAddr + ". Error: " + err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
 	conn, err := wsh.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	log.Println("New connection from " + r.RemoteAddr)
-	defer conn.Close()
+
+	// The upgrader only accepts subprotocols that have a codec
+	codec := CodecForSubprotocol(conn.Subprotocol())
+	connection := NewConnection(conn, codec)
+	connection.userId = claims.Subject
+	defer connection.Wait()
+	defer connection.Close()
+
+	// Upgraded first so the client can be told why it was turned away
+	if err := wsh.admission.Admit(r.RemoteAddr); err != nil {
+		log.Print("Turning away " + r.RemoteAddr + ". " + err.Error())
+		connection.TurnAway(err.Error())
+		return
+	}
+	defer wsh.admission.Release(r.RemoteAddr)
+
+	if _, err := wsh.rooms.Join(roomId, connection); err != nil {
+		log.Print("Could not join room " + roomId + ". Error: " + err.Error())
+		connection.QueueMessage(newErrorMessage(newClientError(ErrorRoomUnavailable, err.Error())))
+		return
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			switch r := r.(type) {
@@ -136,87 +346,67 @@ func (wsh WebsocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		log.Print("Disconnected: " + conn.RemoteAddr().String())
-		for i, connection := range activeConnections {
-			if connection.address == conn.RemoteAddr().String() {
-				// Removes item i
-				activeConnections = append(activeConnections[:i], activeConnections[i+1:]...)
-			}
-			for j, player := range gameState.PlayerStates {
-				if player.Uuid == connection.uuid {
-					// Removes item j
-					gameState.PlayerStates = append(gameState.PlayerStates[:j], gameState.PlayerStates[j+1:]...)
-				}
-			}
-		}
-
-		log.Print("Active connections: ")
-		for _, connection := range activeConnections {
-			log.Print(connection)
-		}
+		wsh.leaveRoom(connection)
 	}()
 
-	connection := new(Connection)
-	connection.address = conn.RemoteAddr().String()
-	connection._lock = new(sync.RWMutex)
-	connection._connection = conn
-
-	activeConnections = append(activeConnections, connection)
-
 	for {
 		messageType, bytes, err := conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Print("Connection to " + connection.address + " timed out")
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				log.Print("Frame from " + connection.address + " exceeded " + fmt.Sprint(ConnectionMaxFrameBytes) + " bytes")
+			} else {
+				log.Println(err)
+			}
 			return
 		}
-		switch messageType {
-		case websocket.BinaryMessage:
-			defer func() {
-				if r := recover(); r != nil {
-					switch r := r.(type) {
-					case runtime.Error:
-						log.Print("Could not handle request properly. " + r.Error() + "\n")
-					default:
-						log.Print(r)
-					}
-				}
-			}()
-			err := HandleBinaryMessage(bytes, conn.RemoteAddr().String())
-			if err != nil {
-				conn.WriteMessage(websocket.TextMessage, []byte("Received message in invalid format"))
-				log.Print("Received message in invalid format. Error: " + err.Error())
-				return
+		connection.ExtendReadDeadline()
+		if messageType != codec.FrameType() {
+			log.Print("Ignoring frame of unexpected type from " + connection.address + " using " + codec.Subprotocol())
+			continue
+		}
+		if err := wsh.handleFrameRecovering(bytes, connection); err != nil {
+			clientErr := asClientError(err)
+			connection.QueueMessage(newErrorMessage(clientErr))
+			log.Print("Could not handle message from " + connection.address + ". " + clientErr.Error())
+			if clientErr.Code == ErrorIncompatibleProtocol {
+				connection.CloseWithReason(CloseIncompatibleProtocol, clientErr.Reason)
 			}
-
-		case websocket.TextMessage:
-			log.Print("Received message in string format: " + string(bytes))
+			return
 		}
-		go updateAllClients()
 	}
 }
 
-// Global variables
-var gameState *types.GameState = new(types.GameState)
-var activeConnections []*Connection
+const DefaultViewRadiusTiles = 8.0
 
-func updateAllClients() {
-	for _, connection := range activeConnections {
-		connection.WriteMessage(websocket.BinaryMessage, gameState.ToBinary())
-	}
-}
+// Where /debug/vars is served unless BLIND_MAZE_ADMIN_ADDR is set. Only
+// reachable from the machine itself.
+const DefaultAdminAddress = "localhost:6060"
 
-func startGlobalTickCycle() {
-	startTimeMs := time.Now().UnixMilli()
-	updates := int64(0)
-	TICK_RATE := int64(240)
-
-	for {
-		for (float64(time.Now().UnixMilli()-startTimeMs))/(float64(1000.0/TICK_RATE)) > float64(updates) {
-			gameState.Tick(1000.0 / float64(TICK_RATE))
-			updates++
-			updateAllClients()
+// Reads BLIND_MAZE_VIEW_RADIUS_TILES (0 for unlimited) and
+// BLIND_MAZE_LINE_OF_SIGHT, keeping defaults for unset values.
+func InterestFromEnv() (types.Interest, error) {
+	interest := types.Interest{
+		RadiusTiles: DefaultViewRadiusTiles,
+		LineOfSight: true,
+	}
+	if raw := os.Getenv("BLIND_MAZE_VIEW_RADIUS_TILES"); raw != "" {
+		radius, err := strconv.ParseFloat(raw, 64)
+		if err != nil || radius < 0 || math.IsNaN(radius) {
+			return interest, errors.New("BLIND_MAZE_VIEW_RADIUS_TILES must be a non-negative number")
 		}
+		interest.RadiusTiles = radius
 	}
-
+	if raw := os.Getenv("BLIND_MAZE_LINE_OF_SIGHT"); raw != "" {
+		lineOfSight, err := strconv.ParseBool(raw)
+		if err != nil {
+			return interest, errors.New("BLIND_MAZE_LINE_OF_SIGHT must be a boolean")
+		}
+		interest.LineOfSight = lineOfSight
+	}
+	return interest, nil
 }
 
 func main() {
@@ -239,17 +429,79 @@ func main() {
 
 	host := fmt.Sprintf("%s:%d", hostIp, port)
 
-	gameState.MapLayout = generation.GenerateMap()
+	// Stats are only served here, never on the public game port
+	adminHost := os.Getenv("BLIND_MAZE_ADMIN_ADDR")
+	if adminHost == "" {
+		adminHost = DefaultAdminAddress
+	}
+
+	schedulerConfig, err := SchedulerConfigFromEnv()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	interest, err := InterestFromEnv()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	devMode, err := DevModeFromEnv()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if devMode {
+		log.Print("Dev mode: clients may join without an access token and from localhost")
+	}
+	auth, err := AuthFromEnv(devMode)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	originPolicy, err := OriginPolicyFromEnv(devMode)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	admissionConfig, err := AdmissionConfigFromEnv()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	admission := NewAdmission(admissionConfig)
+	rooms := NewRoomRegistry(RoomConfig{
+		Scheduler:  schedulerConfig,
+		Interest:   interest,
+		MaxPlayers: admissionConfig.MaxPlayersPerRoom,
+		QueueSize:  admissionConfig.RoomQueueSize,
+	}, admissionConfig.MaxRooms)
+	expvar.Publish("rooms", expvar.Func(rooms.Stats))
+	expvar.Publish("admission", expvar.Func(admission.Stats))
+	if _, err := rooms.Create(DefaultRoomId); err != nil {
+		log.Print(err)
+		return
+	}
 
 	webSocketHandler := WebsocketHandler{
 		upgrader: websocket.Upgrader{
-			CheckOrigin: CheckOrigin,
+			CheckOrigin:  originPolicy.CheckOrigin,
+			Subprotocols: Subprotocols(),
 		},
+		rooms:     rooms,
+		auth:      auth,
+		admission: admission,
 	}
 
-	go startGlobalTickCycle()
+	admin := http.NewServeMux()
+	admin.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		log.Println("Started admin server @ " + adminHost)
+		log.Fatal(http.ListenAndServe(adminHost, admin))
+	}()
 
-	http.Handle("/", webSocketHandler)
+	game := http.NewServeMux()
+	game.Handle("/", webSocketHandler)
+	game.Handle("/rooms/{roomId}", webSocketHandler)
 	log.Println("Started server @ " + host)
-	log.Fatal(http.ListenAndServe(host, nil))
+	log.Fatal(http.ListenAndServe(host, game))
 }
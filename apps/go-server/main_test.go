@@ -0,0 +1,743 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rashrasa/blind-maze/apps/go-server/types"
+)
+
+// Connection without a socket or writer goroutine. Queued frames pile up
+// until the queue fills and the connection marks itself closed.
+func newTestConnection() *Connection {
+	return &Connection{
+		address:        "test",
+		codec:          binaryCodec{},
+		limiter:        NewRateLimiter(DefaultRateLimits(), DefaultConnectionRateLimit),
+		outbound:       make(chan []byte, ConnectionSendQueueSize),
+		_lock:          new(sync.Mutex),
+		_snapshotReady: make(chan struct{}, 1),
+		_stop:          make(chan struct{}),
+		_stopOnce:      new(sync.Once),
+		_done:          make(chan struct{}),
+	}
+}
+
+func newTestHandler(t testing.TB) WebsocketHandler {
+	return newTestHandlerWithConfig(t, RoomConfig{
+		Scheduler: DefaultSchedulerConfig(),
+		Interest:  types.Interest{RadiusTiles: DefaultViewRadiusTiles, LineOfSight: true},
+	})
+}
+
+func newTestHandlerWithConfig(t testing.TB, config RoomConfig) WebsocketHandler {
+	rooms := NewRoomRegistry(config, 2)
+	if _, err := rooms.Create(DefaultRoomId); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rooms.Close(DefaultRoomId)
+	})
+	return WebsocketHandler{rooms: rooms, auth: Auth{DevMode: true}}
+}
+
+func joinMessage(uuid string, roomId string) []byte {
+	message := append([]byte{ClientNewConnectionMessage}, types.EncodeString(uuid)...)
+	if roomId != "" {
+		message = append(message, types.EncodeString(roomId)...)
+	}
+	return message
+}
+
+// Returns: the next snapshot the room queues for the connection
+func waitForSnapshot(t *testing.T, connection *Connection) []byte {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if snapshot := connection.takeSnapshot(); snapshot != nil {
+			return snapshot
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no snapshot queued")
+	return nil
+}
+
+// Returns: the types of every frame queued for the connection so far
+func drainFrameTypes(connection *Connection) []uint8 {
+	frameTypes := []uint8{}
+	for len(connection.outbound) > 0 {
+		frameTypes = append(frameTypes, (<-connection.outbound)[0])
+	}
+	return frameTypes
+}
+
+// The tick loop encodes snapshots with a connection's features while its
+// reader negotiates them, so run with -race too.
+func TestHelloDuringTicks(t *testing.T) {
+	handler := newTestHandler(t)
+	connection := newTestConnection()
+	if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.room.RemoveConnection(connection)
+
+	// Another player joins while the connection has not sent its hello
+	other := newTestConnection()
+	if _, err := handler.rooms.Join(DefaultRoomId, other); err != nil {
+		t.Fatal(err)
+	}
+	defer other.room.RemoveConnection(other)
+	other.Negotiate(ProtocolVersion, 0)
+	if err := handler.HandleFrame(joinMessage("other", ""), other); err != nil {
+		t.Fatal(err)
+	}
+	joined := make(chan struct{})
+	other.room.Send(inspectCommand(func(room *Room) { close(joined) }))
+	<-joined
+
+	// Let the room tick with the connection in it before the hello
+	time.Sleep(50 * time.Millisecond)
+	if len(connection.outbound) > 0 || connection.takeSnapshot() != nil {
+		t.Fatal("frame queued before the hello")
+	}
+	hello := binary.BigEndian.AppendUint16([]byte{ClientHelloMessage}, ProtocolVersion)
+	hello = binary.BigEndian.AppendUint32(hello, FeatureLatency|FeatureQuantizedSnapshots)
+	if err := handler.HandleFrame(hello, connection); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForSnapshot(t, connection)
+	if frame := <-connection.outbound; frame[0] != ServerWelcomeMessage {
+		t.Fatalf("first frame has type %d, want the welcome", frame[0])
+	}
+	if frame := <-connection.outbound; frame[0] != ServerMapMessage {
+		t.Fatalf("second frame has type %d, want the map", frame[0])
+	}
+}
+
+// Decodes an unquantized keyframe as a client speaking the version would.
+func decodeKeyframe(frame []byte, version uint16) (types.StateUpdate, uint32, error) {
+	decoder := types.NewDecoder(frame)
+	decoder.Uint8("messageType")
+	mapVersion := uint32(0)
+	if version >= 3 {
+		mapVersion = decoder.Uint32("mapVersion")
+	}
+	update := types.StateUpdate{
+		TickNumber:                 decoder.Uint64("serverTick"),
+		LastProcessedInputSequence: decoder.Uint32("lastProcessedInputSequence"),
+		Kind:                       decoder.Uint8("snapshotKind"),
+	}
+	for range decoder.Uint32("numPlayers") {
+		player := types.DecodePlayerSnapshot(decoder)
+		update.Players = append(update.Players, &player)
+	}
+	for range decoder.Uint32("numParticles") {
+		particle := types.DecodeParticle(decoder)
+		update.Particles = append(update.Particles, &particle)
+	}
+	return update, mapVersion, decoder.Finish()
+}
+
+// Clients one version behind are still welcomed and sent snapshots in the
+// layout they know during rollouts.
+func TestPreviousProtocolVersion(t *testing.T) {
+	for _, version := range []uint16{MinProtocolVersion, ProtocolVersion} {
+		handler := newTestHandler(t)
+		connection := newTestConnection()
+		if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+			t.Fatal(err)
+		}
+		defer connection.room.RemoveConnection(connection)
+
+		hello := binary.BigEndian.AppendUint16([]byte{ClientHelloMessage}, version)
+		hello = binary.BigEndian.AppendUint32(hello, 0)
+		if err := handler.HandleFrame(hello, connection); err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if err := handler.HandleFrame(joinMessage("player", ""), connection); err != nil {
+			t.Fatal(err)
+		}
+
+		var update types.StateUpdate
+		var mapVersion uint32
+		for len(update.Players) == 0 {
+			var err error
+			update, mapVersion, err = decodeKeyframe(waitForSnapshot(t, connection), version)
+			if err != nil {
+				t.Fatalf("version %d: snapshot does not parse: %v", version, err)
+			}
+		}
+		if update.Kind != types.SnapshotKeyframe || update.Players[0].Uuid != "player" {
+			t.Errorf("version %d: parsed %+v", version, update)
+		}
+		if version >= 3 && mapVersion != connection.room.mapVersion {
+			t.Errorf("version %d: map version %d, want %d", version, mapVersion, connection.room.mapVersion)
+		}
+
+		welcome := <-connection.outbound
+		if welcome[0] != ServerWelcomeMessage || binary.BigEndian.Uint16(welcome[1:3]) != version {
+			t.Errorf("version %d: first frame %v, want a welcome for the version", version, welcome)
+		}
+	}
+
+	// Clients from before the handshake are more than one version behind
+	handler := newTestHandler(t)
+	connection := newTestConnection()
+	if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.room.RemoveConnection(connection)
+	err := handler.HandleFrame(joinMessage("player", ""), connection)
+	if err == nil || asClientError(err).Code != ErrorIncompatibleProtocol {
+		t.Errorf("join without a hello returned %v", err)
+	}
+}
+
+func FuzzHandleFrame(f *testing.F) {
+	hello := binary.BigEndian.AppendUint16([]byte{ClientHelloMessage}, ProtocolVersion)
+	hello = binary.BigEndian.AppendUint32(hello, SupportedFeatures)
+	input := binary.BigEndian.AppendUint32([]byte{ClientInputMessage}, 1)
+	input = append(input, types.InputRight)
+	ack := binary.BigEndian.AppendUint64([]byte{ClientAckMessage}, 1)
+	update := append([]byte{ClientUpdateRequestMessage}, (&types.PlayerSnapshot{Uuid: "a"}).ToBinary()...)
+	particle := append([]byte{ClientReleaseParticleMessage}, make([]byte, 40)...)
+	spectate := append([]byte{ClientSpectateMessage}, types.EncodeString("a")...)
+
+	f.Add([]byte{}, []byte{})
+	f.Add(hello, joinMessage("a", ""))
+	f.Add(joinMessage("a", "other"), input)
+	f.Add(joinMessage("a", ""), ack)
+	f.Add(joinMessage("a", ""), update)
+	f.Add(joinMessage("a", ""), particle)
+	f.Add(spectate, joinMessage("a", ""))
+	f.Add([]byte{ClientNewConnectionMessage, 0xff, 0xff, 0xff, 0xff}, []byte{0xff})
+
+	// Every handled message logs
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	handler := newTestHandler(f)
+
+	// Two messages per run so messages after a join are reached
+	f.Fuzz(func(t *testing.T, first []byte, second []byte) {
+		connection := newTestConnection()
+		if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+			t.Fatal(err)
+		}
+		if len(first) == 0 || first[0] != ClientHelloMessage {
+			// Skips the handshake every other message must follow
+			connection.Negotiate(ProtocolVersion, SupportedFeatures)
+		}
+		defer func() {
+			room := connection.room
+			room.RemoveConnection(connection)
+			handler.rooms.CloseIfEmpty(room.Id)
+		}()
+
+		for _, p := range [][]byte{first, second} {
+			err := handler.HandleFrame(p, connection)
+			if err == nil {
+				continue
+			}
+			var clientErr *ClientError
+			var decodeErr *types.DecodeError
+			if !errors.As(err, &clientErr) && !errors.As(err, &decodeErr) {
+				t.Fatalf("untyped error: %v", err)
+			}
+			return
+		}
+	})
+}
+
+func TestOriginPolicy(t *testing.T) {
+	policy, err := NewOriginPolicy([]string{"https://blind-maze.app", "https://*.blind-maze.app", "http://localhost:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, allowed := range map[string]bool{
+		"https://blind-maze.app":          true,
+		"https://BLIND-MAZE.app":          true,
+		"https://www.blind-maze.app":      true,
+		"https://a.b.blind-maze.app":      true,
+		"http://blind-maze.app":           false,
+		"https://blind-maze.app:8443":     false,
+		"https://evilblind-maze.app":      false,
+		"https://blind-maze.app.evil.com": false,
+		"http://localhost:3000":           true,
+		"http://localhost":                true,
+		"https://localhost:3000":          false,
+		"null":                            false,
+	} {
+		if policy.Allows(origin) != allowed {
+			t.Errorf("Allows(%q) = %v, want %v", origin, !allowed, allowed)
+		}
+	}
+
+	for _, invalid := range []string{"blind-maze.app", "https://*", "https://a.*.app", "https://blind-maze.app/path"} {
+		if _, err := NewOriginPolicy([]string{invalid}); err == nil {
+			t.Errorf("%q was accepted", invalid)
+		}
+	}
+}
+
+func TestMovementTracker(t *testing.T) {
+	// 8x3 tiles with walls at x = 0 and x = 7
+	layout := types.MapLayout{Width: 8, Height: 3, Tiles: [][]byte{{0b1000_0001}, {0b1000_0001}, {0b1000_0001}}}
+	start := time.Now()
+	snapshot := func(x float64, y float64, speed float64, afterMs uint64) types.PlayerSnapshot {
+		return types.PlayerSnapshot{
+			Position:            types.Vector2[float64]{X: x, Y: y},
+			Velocity:            types.Vector2[float64]{X: speed},
+			SnapshotTimestampMs: 1000 + afterMs,
+		}
+	}
+
+	for name, test := range map[string]struct {
+		snapshot types.PlayerSnapshot
+		want     string
+	}{
+		"walking":          {snapshot(2.5, 1.5, types.PLAYER_SPEED_TILES_PER_SECOND, 100), ""},
+		"too fast":         {snapshot(4.5, 1.5, types.PLAYER_SPEED_TILES_PER_SECOND, 100), "speed"},
+		"fast velocity":    {snapshot(2, 1.5, 100, 100), "speed"},
+		"forged timestamp": {snapshot(4.9, 1.5, 0, 100_000), "speed"},
+		"teleport":         {snapshot(6.5, 0.5, 0, 100_000), "teleport"},
+		"inside wall":      {snapshot(0.5, 1.5, 0, 1000), "inside wall"},
+		"not a number":     {snapshot(math.NaN(), 1.5, 0, 100), "teleport"},
+	} {
+		tracker := newMovementTracker(&types.PlayerSnapshot{
+			Position:            types.Vector2[float64]{X: 2, Y: 1.5},
+			SnapshotTimestampMs: 1000,
+		}, start)
+		violations := tracker.check(test.snapshot, &layout, start.Add(100*time.Millisecond))
+		if got := describeViolations(violations); got != test.want {
+			t.Errorf("%s: violations = %q, want %q", name, got, test.want)
+		}
+	}
+}
+
+// A client snapped back is sent a keyframe, even when acks for snapshots it
+// was sent before the snap-back arrive afterwards.
+func TestSnapBackSendsKeyframe(t *testing.T) {
+	handler := newTestHandler(t)
+	connection := newTestConnection()
+	if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+		t.Fatal(err)
+	}
+	defer connection.room.RemoveConnection(connection)
+	connection.Negotiate(ProtocolVersion, FeatureDeltaSnapshots)
+	if err := handler.HandleFrame(joinMessage("cheater", ""), connection); err != nil {
+		t.Fatal(err)
+	}
+	waitForSnapshot(t, connection)
+
+	ticks := make(chan uint64)
+	inspect := inspectCommand(func(room *Room) {
+		ticks <- room.client(connection).ackedTick
+		ticks <- room.gameState.TickNumber
+	})
+	connection.room.Send(inspect)
+	<-ticks
+	sent := <-ticks
+
+	teleport := types.PlayerSnapshot{Uuid: "cheater", Position: types.Vector2[float64]{X: 50, Y: 50}}
+	if err := handler.HandleFrame(append([]byte{ClientUpdateRequestMessage}, teleport.ToBinary()...), connection); err != nil {
+		t.Fatal(err)
+	}
+	// In flight when the teleport was rejected
+	stale := binary.BigEndian.AppendUint64([]byte{ClientAckMessage}, sent)
+	if err := handler.HandleFrame(stale, connection); err != nil {
+		t.Fatal(err)
+	}
+	connection.room.Send(inspect)
+	if acked := <-ticks; acked != 0 {
+		t.Errorf("stale ack for tick %d was recorded as the baseline", acked)
+	}
+	<-ticks
+
+	connection.takeSnapshot()
+	update, _, err := decodeKeyframe(waitForSnapshot(t, connection), ProtocolVersion)
+	if err != nil || update.Kind != types.SnapshotKeyframe {
+		t.Fatalf("snapshot after the snap-back is not a keyframe: %v", err)
+	}
+	fresh := binary.BigEndian.AppendUint64([]byte{ClientAckMessage}, update.TickNumber)
+	if err := handler.HandleFrame(fresh, connection); err != nil {
+		t.Fatal(err)
+	}
+	connection.room.Send(inspect)
+	if acked := <-ticks; acked != update.TickNumber {
+		t.Errorf("ack for the keyframe at tick %d recorded as %d", update.TickNumber, acked)
+	}
+	<-ticks
+}
+
+func TestAdmission(t *testing.T) {
+	admission := NewAdmission(AdmissionConfig{MaxConnections: 3, MaxConnectionsPerAddress: 2})
+	for _, step := range []struct {
+		address string
+		want    error
+	}{
+		{"10.0.0.1:5000", nil},
+		{"10.0.0.1:5001", nil},
+		{"10.0.0.1:5002", ErrTooManyConnections},
+		{"[::1]:5000", nil},
+		{"10.0.0.2:5000", ErrServerFull},
+	} {
+		if err := admission.Admit(step.address); err != step.want {
+			t.Fatalf("Admit(%q) = %v, want %v", step.address, err, step.want)
+		}
+	}
+
+	admission.Release("10.0.0.1:5000")
+	if err := admission.Admit("10.0.0.2:5000"); err != nil {
+		t.Fatalf("connection not admitted after a release: %v", err)
+	}
+	if stats := admission.Stats().(AdmissionStats); stats.Connections != 3 || stats.Addresses != 3 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestRoomLimit(t *testing.T) {
+	handler := newTestHandler(t)
+	connection := newTestConnection()
+	if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.moveConnection(connection, "second"); err != nil {
+		t.Fatalf("second room not created: %v", err)
+	}
+	defer handler.rooms.Close("second")
+	if err := handler.moveConnection(connection, "third"); !errors.Is(err, ErrTooManyRooms) {
+		t.Fatalf("moveConnection past the room limit = %v, want %v", err, ErrTooManyRooms)
+	}
+	if connection.room.Id != "second" || handler.rooms.Len() != 2 {
+		t.Errorf("connection in room %q with %d rooms open", connection.room.Id, handler.rooms.Len())
+	}
+	connection.room.RemoveConnection(connection)
+}
+
+// Operators can tell from the stats which clients are being throttled.
+func TestThrottledStats(t *testing.T) {
+	handler := newTestHandler(t)
+	throttled, quiet := newTestConnection(), newTestConnection()
+	quiet.address = "quiet"
+	for _, connection := range []*Connection{throttled, quiet} {
+		if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+			t.Fatal(err)
+		}
+		defer connection.room.RemoveConnection(connection)
+		connection.Negotiate(ProtocolVersion, FeatureDeltaSnapshots)
+	}
+
+	ack := binary.BigEndian.AppendUint64([]byte{ClientAckMessage}, 1)
+	for range 40 {
+		handler.HandleFrame(ack, throttled)
+	}
+	handler.HandleFrame(ack, quiet)
+
+	stats := handler.rooms.Stats().(map[string]RoomStats)[DefaultRoomId]
+	dropped := throttled.throttled.Load()
+	if dropped == 0 || stats.Throttled[throttled.address] != dropped {
+		t.Errorf("throttled client listed with %d dropped messages, want %d", stats.Throttled[throttled.address], dropped)
+	}
+	if _, listed := stats.Throttled[quiet.address]; listed {
+		t.Error("client that was never throttled is listed")
+	}
+	if stats.ThrottledConnections != 1 || stats.ThrottledMessages != dropped {
+		t.Errorf("totals are %d connections and %d messages", stats.ThrottledConnections, stats.ThrottledMessages)
+	}
+}
+
+// Resume tokens are only issued to joins the room admits.
+func TestSessionIssuedOnAdmission(t *testing.T) {
+	handler := newTestHandlerWithConfig(t, RoomConfig{Scheduler: DefaultSchedulerConfig(), MaxPlayers: 1})
+	admitted, turnedAway := newTestConnection(), newTestConnection()
+	for _, connection := range []*Connection{admitted, turnedAway} {
+		if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+			t.Fatal(err)
+		}
+		defer connection.room.RemoveConnection(connection)
+		connection.Negotiate(ProtocolVersion, FeatureSessionResume)
+	}
+
+	if err := handler.HandleFrame(joinMessage("admitted", ""), admitted); err != nil {
+		t.Fatal(err)
+	}
+	waitForSnapshot(t, admitted)
+	if err := handler.HandleFrame(joinMessage("turned away", ""), turnedAway); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-turnedAway._stop:
+	case <-time.After(time.Second):
+		t.Fatal("join to the full room was not turned away")
+	}
+
+	if admitted.SessionToken() == "" || !slices.Contains(drainFrameTypes(admitted), ServerSessionMessage) {
+		t.Error("admitted player was not sent a session token")
+	}
+	if turnedAway.SessionToken() != "" || slices.Contains(drainFrameTypes(turnedAway), ServerSessionMessage) {
+		t.Error("turned away client was sent a session token")
+	}
+}
+
+// A second connection joining with a uuid that is already playing must not
+// get a player of its own or control the first connection's.
+func TestDuplicateJoin(t *testing.T) {
+	handler := newTestHandler(t)
+	first, second := newTestConnection(), newTestConnection()
+	for _, connection := range []*Connection{first, second} {
+		if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+			t.Fatal(err)
+		}
+		defer connection.room.RemoveConnection(connection)
+		connection.Negotiate(ProtocolVersion, 0)
+		if err := handler.HandleFrame(joinMessage("player", ""), connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-second._stop:
+	case <-time.After(time.Second):
+		t.Fatal("duplicate join was not refused")
+	}
+	if !slices.Contains(drainFrameTypes(second), ServerErrorMessage) {
+		t.Error("duplicate join was not told why it was refused")
+	}
+
+	input := binary.BigEndian.AppendUint32([]byte{ClientInputMessage}, 1)
+	if err := handler.HandleFrame(append(input, types.InputRight), second); err != nil {
+		t.Fatal(err)
+	}
+	players := make(chan []types.PlayerSnapshot)
+	first.room.Send(inspectCommand(func(room *Room) {
+		snapshots := []types.PlayerSnapshot{}
+		for _, player := range room.gameState.PlayerStates {
+			snapshots = append(snapshots, *player)
+		}
+		players <- snapshots
+	}))
+	if snapshots := <-players; len(snapshots) != 1 || snapshots[0].InputKeys != 0 {
+		t.Errorf("players after a duplicate join: %+v", snapshots)
+	}
+}
+
+// Runs a function on the tick loop so tests can look at the game state.
+type inspectCommand func(room *Room)
+
+func (command inspectCommand) apply(room *Room) { command(room) }
+
+// A plain join during a player's grace period takes the player over rather
+// than leaving it behind as a ghost.
+func TestJoinDuringGracePeriod(t *testing.T) {
+	for _, features := range []uint32{0, FeatureSessionResume} {
+		handler := newTestHandler(t)
+		sessions := handler.rooms.sessions
+		detached, joining := newTestConnection(), newTestConnection()
+		for _, connection := range []*Connection{detached, joining} {
+			if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+				t.Fatal(err)
+			}
+			defer connection.room.RemoveConnection(connection)
+		}
+		detached.Negotiate(ProtocolVersion, FeatureSessionResume)
+		joining.Negotiate(ProtocolVersion, features)
+
+		if err := handler.HandleFrame(joinMessage("player", ""), detached); err != nil {
+			t.Fatal(err)
+		}
+		waitForSnapshot(t, detached)
+		token := detached.SessionToken()
+		if !sessions.Detach(token, detached) {
+			t.Fatal("session not detached")
+		}
+		detached.room.DetachConnection(detached)
+
+		if err := handler.HandleFrame(joinMessage("player", ""), joining); err != nil {
+			t.Fatal(err)
+		}
+		waitForSnapshot(t, joining)
+		players := make(chan int)
+		joining.room.Send(inspectCommand(func(room *Room) {
+			if room.playerOf(joining) == nil {
+				players <- 0
+				return
+			}
+			players <- len(room.gameState.PlayerStates)
+		}))
+		if count := <-players; count != 1 {
+			t.Errorf("features %d: joining connection has no player or a ghost is left, %d players", features, count)
+		}
+
+		sessions._lock.Lock()
+		session, exists := sessions.sessions[token]
+		var owner *Connection
+		if exists {
+			owner = session.connection
+		}
+		sessions._lock.Unlock()
+		if features&FeatureSessionResume != 0 {
+			if owner != joining || joining.SessionToken() != token {
+				t.Errorf("session not handed to the joining connection")
+			}
+		} else if exists {
+			t.Errorf("session still resumable after a takeover by a client that cannot resume")
+		}
+	}
+}
+
+// Kicked clients must not be able to resume their player.
+func TestKickRevokesSession(t *testing.T) {
+	handler := newTestHandler(t)
+	connection := newTestConnection()
+	if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+		t.Fatal(err)
+	}
+	connection.Negotiate(ProtocolVersion, FeatureSessionResume)
+	if err := handler.HandleFrame(joinMessage("cheater", ""), connection); err != nil {
+		t.Fatal(err)
+	}
+	waitForSnapshot(t, connection)
+	token := connection.SessionToken()
+
+	resuming := newTestConnection()
+	connection.Kick("test")
+	if _, _, claimed := handler.rooms.sessions.Claim(token, "", resuming); claimed {
+		t.Error("session of a kicked connection resumed before it disconnected")
+	}
+	handler.leaveRoom(connection)
+	if _, _, claimed := handler.rooms.sessions.Claim(token, "", resuming); claimed {
+		t.Error("session of a kicked connection resumed after it disconnected")
+	}
+
+	players := make(chan int)
+	room, _ := handler.rooms.Get(DefaultRoomId)
+	room.Send(inspectCommand(func(room *Room) {
+		players <- len(room.gameState.PlayerStates)
+	}))
+	if count := <-players; count != 0 {
+		t.Errorf("kicked player still in the room, %d players", count)
+	}
+}
+
+func TestSpectatorRestrictions(t *testing.T) {
+	handler := newTestHandler(t)
+	handler.auth = Auth{secret: []byte("secret"), spectators: map[string]bool{"watcher": true, "player": true}}
+	connect := func(userId string) *Connection {
+		connection := newTestConnection()
+		connection.userId = userId
+		if _, err := handler.rooms.Join(DefaultRoomId, connection); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { connection.room.RemoveConnection(connection) })
+		connection.Negotiate(ProtocolVersion, 0)
+		return connection
+	}
+	spectate := append([]byte{ClientSpectateMessage}, types.EncodeString("")...)
+	refused := func(connection *Connection) bool {
+		select {
+		case <-connection._stop:
+			return slices.Contains(drainFrameTypes(connection), ServerErrorMessage)
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	if err := handler.HandleFrame(joinMessage("", ""), connect("player")); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.HandleFrame(spectate, connect("stranger")); asClientError(err).Code != ErrorUnauthorized {
+		t.Errorf("unlisted user spectating: %v", err)
+	}
+	playerSpectating := connect("player")
+	if err := handler.HandleFrame(spectate, playerSpectating); err != nil {
+		t.Fatal(err)
+	}
+	if !refused(playerSpectating) {
+		t.Error("player allowed to spectate its own room")
+	}
+
+	watcher := connect("watcher")
+	if err := handler.HandleFrame(spectate, watcher); err != nil {
+		t.Fatal(err)
+	}
+	watcherJoining := connect("watcher")
+	if err := handler.HandleFrame(joinMessage("", ""), watcherJoining); err != nil {
+		t.Fatal(err)
+	}
+	if !refused(watcherJoining) {
+		t.Error("spectator allowed to join the room it is spectating")
+	}
+	if slices.Contains(drainFrameTypes(watcher), ServerErrorMessage) {
+		t.Error("listed user not allowed to spectate")
+	}
+}
+
+// Signs a token the way Supabase does, with whatever header and claims given.
+func signToken(secret string, header string, claims string) string {
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	auth := Auth{secret: []byte("secret")}
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+	valid := `{"sub":"user","exp":1700000060,"role":"authenticated"}`
+	validToken := signToken("secret", hs256, valid)
+	parts := strings.Split(validToken, ".")
+	unsigned := parts[0] + "." + parts[1]
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":1700000060}`)) + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		auth  Auth
+		token string
+		want  error
+	}{
+		{"valid", auth, validToken, nil},
+		{"valid with nbf", auth, signToken("secret", hs256, `{"sub":"user","exp":1700000060,"nbf":1699999990}`), nil},
+		{"bad signature", auth, signToken("other secret", hs256, valid), ErrInvalidToken},
+		{"tampered claims", auth, tampered, ErrInvalidToken},
+		{"alg none", auth, base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(valid)) + ".", ErrInvalidToken},
+		{"alg HS512", auth, signToken("secret", `{"alg":"HS512"}`, valid), ErrInvalidToken},
+		{"expired", auth, signToken("secret", hs256, `{"sub":"user","exp":1700000000}`), ErrTokenExpired},
+		{"nbf in the future", auth, signToken("secret", hs256, `{"sub":"user","exp":1700000060,"nbf":1700000030}`), ErrInvalidToken},
+		{"missing sub", auth, signToken("secret", hs256, `{"exp":1700000060}`), ErrInvalidToken},
+		{"missing exp", auth, signToken("secret", hs256, `{"sub":"user"}`), ErrInvalidToken},
+		{"two segments", auth, unsigned, ErrInvalidToken},
+		{"four segments", auth, validToken + ".", ErrInvalidToken},
+		{"malformed header", auth, "!!!." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"malformed claims", auth, signToken("secret", hs256, `not json`), ErrInvalidToken},
+		{"malformed signature", auth, unsigned + ".!!!", ErrInvalidToken},
+		{"empty token", auth, "", ErrInvalidToken},
+		{"empty secret", Auth{DevMode: true}, signToken("", hs256, valid), ErrInvalidToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.auth.Verify(test.token, now)
+			if err != test.want {
+				t.Fatalf("Verify() = %v, want %v", err, test.want)
+			}
+			if err == nil && claims.Subject != "user" {
+				t.Errorf("Subject = %q, want %q", claims.Subject, "user")
+			}
+		})
+	}
+}
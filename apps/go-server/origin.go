@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Allowed in dev mode on top of any configured origins
+var DevOrigins = []string{"http://localhost:*", "http://127.0.0.1:*"}
+
+// One allowed origin, e.g. https://blind-maze.app, https://*.blind-maze.app
+// (subdomains only) or http://localhost:* (any port).
+type originPattern struct {
+	scheme string
+	// Leading "." for wildcard subdomains
+	host string
+	// Empty for the scheme's default port, "*" for any
+	port string
+}
+
+func parseOriginPattern(pattern string) (originPattern, error) {
+	invalid := fmt.Errorf("invalid origin %q", pattern)
+	scheme, host, found := strings.Cut(strings.ToLower(strings.TrimSpace(pattern)), "://")
+	if !found || scheme == "" {
+		return originPattern{}, invalid
+	}
+	host = strings.TrimSuffix(host, "/")
+	port := ""
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host, port = host[:i], host[i+1:]
+		if port == "" {
+			return originPattern{}, invalid
+		}
+	}
+	if strings.HasPrefix(host, "*.") {
+		host = host[1:]
+	}
+	if host == "" || host == "." || strings.ContainsAny(host, "*/") {
+		return originPattern{}, invalid
+	}
+	return originPattern{scheme: scheme, host: host, port: port}, nil
+}
+
+func (pattern originPattern) matches(origin *url.URL) bool {
+	if origin.Scheme != pattern.scheme {
+		return false
+	}
+	if pattern.port != "*" && origin.Port() != pattern.port {
+		return false
+	}
+	host := origin.Hostname()
+	if strings.HasPrefix(pattern.host, ".") {
+		return strings.HasSuffix(host, pattern.host)
+	}
+	return host == pattern.host
+}
+
+// Browser origins allowed to open a WebSocket, guarding against cross-site
+// WebSocket hijacking of logged-in users.
+type OriginPolicy struct {
+	patterns []originPattern
+}
+
+func NewOriginPolicy(origins []string) (OriginPolicy, error) {
+	policy := OriginPolicy{}
+	for _, origin := range origins {
+		pattern, err := parseOriginPattern(origin)
+		if err != nil {
+			return policy, err
+		}
+		policy.patterns = append(policy.patterns, pattern)
+	}
+	return policy, nil
+}
+
+// Reads comma separated origins from BLIND_MAZE_ALLOWED_ORIGINS and one origin
+// per line from the file at BLIND_MAZE_ALLOWED_ORIGINS_FILE. Localhost is
+// allowed in dev mode, otherwise at least one origin must be configured.
+func OriginPolicyFromEnv(devMode bool) (OriginPolicy, error) {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("BLIND_MAZE_ALLOWED_ORIGINS"), ",") {
+		if strings.TrimSpace(origin) != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if path := os.Getenv("BLIND_MAZE_ALLOWED_ORIGINS_FILE"); path != "" {
+		fromFile, err := readOriginsFile(path)
+		if err != nil {
+			return OriginPolicy{}, err
+		}
+		origins = append(origins, fromFile...)
+	}
+	if devMode {
+		origins = append(origins, DevOrigins...)
+	}
+	if len(origins) == 0 {
+		return OriginPolicy{}, errors.New("BLIND_MAZE_ALLOWED_ORIGINS or BLIND_MAZE_ALLOWED_ORIGINS_FILE must be set unless BLIND_MAZE_DEV_MODE is on")
+	}
+	return NewOriginPolicy(origins)
+}
+
+// Blank lines and lines starting with # are skipped.
+func readOriginsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	origins := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		origins = append(origins, line)
+	}
+	return origins, scanner.Err()
+}
+
+func (policy OriginPolicy) Allows(origin string) bool {
+	parsed, err := url.Parse(strings.ToLower(origin))
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	for _, pattern := range policy.patterns {
+		if pattern.matches(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Used as the upgrader's CheckOrigin. Requests without an Origin header do
+// not come from a browser, so they cannot be hijacked and are let through.
+func (policy OriginPolicy) CheckOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" || policy.Allows(origin) {
+		return true
+	}
+	log.Print("Rejected WebSocket upgrade from " + request.RemoteAddr + " with origin " + origin)
+	return false
+}
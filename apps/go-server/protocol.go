@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/rashrasa/blind-maze/apps/go-server/types"
+)
+
+const ClientNewConnectionMessage uint8 = 0
+const ClientUpdateRequestMessage uint8 = 1
+const ClientReleaseParticleMessage uint8 = 2
+const ClientInputMessage uint8 = 3
+const ClientAckMessage uint8 = 4
+const ClientHelloMessage uint8 = 5
+const ClientResumeMessage uint8 = 6
+const ClientSpectateMessage uint8 = 7
+
+// Every binary frame sent by the server starts with one of these
+const ServerStateMessage uint8 = 0
+const ServerMapMessage uint8 = 1
+const ServerWelcomeMessage uint8 = 2
+const ServerPlayerJoinedMessage uint8 = 3
+const ServerPlayerLeftMessage uint8 = 4
+const ServerKickedMessage uint8 = 5
+const ServerErrorMessage uint8 = 6
+const ServerSessionMessage uint8 = 7
+const ServerFullMessage uint8 = 8
+const ServerQueuedMessage uint8 = 9
+const ServerSpectatingMessage uint8 = 10
+
+// Codes sent in a ServerErrorMessage
+const (
+	ErrorInvalidMessage uint16 = iota + 1
+	ErrorUnknownMessageType
+	ErrorNotJoined
+	ErrorIncompatibleProtocol
+	ErrorRoomUnavailable
+	ErrorSessionExpired
+	ErrorUnauthorized
+	ErrorRateLimited
+	ErrorAlreadyPlaying
+)
+
+// Wire protocol spoken by this server. Every client must open with a hello.
+// Clients one version behind are still served during rollouts, in the layout
+// they expect; older ones, including those that predate the handshake, are
+// turned away rather than misparsing frames.
+//
+// Version 3 added the map version to state messages.
+const ProtocolVersion uint16 = 3
+const MinProtocolVersion uint16 = 2
+
+// Optional features a client can ask for in its hello
+const (
+	// Client acks snapshots and understands SnapshotDelta
+	FeatureDeltaSnapshots uint32 = 1 << iota
+	// Binary snapshots use the quantized PlayerSnapshot and Particle encodings
+	FeatureQuantizedSnapshots
+	// Snapshots carry the recipient's round trip time
+	FeatureLatency
+	// Client is sent a resume token on join and may resume after a disconnect
+	FeatureSessionResume
+)
+
+// Features this server can provide
+const SupportedFeatures = FeatureDeltaSnapshots | FeatureQuantizedSnapshots | FeatureLatency | FeatureSessionResume
+
+// Close code sent to clients whose hello cannot be accepted
+const CloseIncompatibleProtocol = 4001
+
+// Close code sent along with a ServerFullMessage
+const CloseServerFull = 4002
+
+// Problem with a client's message, reported back to it in a ServerErrorMessage.
+type ClientError struct {
+	Code   uint16
+	Reason string
+}
+
+func (err *ClientError) Error() string {
+	return fmt.Sprintf("error %d: %s", err.Code, err.Reason)
+}
+
+func newClientError(code uint16, reason string) *ClientError {
+	return &ClientError{Code: code, Reason: reason}
+}
+
+// Errors that are not a *ClientError are reported as ErrorInvalidMessage.
+func asClientError(err error) *ClientError {
+	var clientErr *ClientError
+	if errors.As(err, &clientErr) {
+		return clientErr
+	}
+	return newClientError(ErrorInvalidMessage, err.Error())
+}
+
+// Agrees on a version and feature set for a client's hello.
+// Returns: negotiated version; accepted features
+func negotiate(version uint16, requested uint32) (uint16, uint32, error) {
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return 0, 0, newClientError(ErrorIncompatibleProtocol, fmt.Sprintf(
+			"unsupported protocol version %d, server supports %d to %d",
+			version, MinProtocolVersion, ProtocolVersion,
+		))
+	}
+	return version, requested & SupportedFeatures, nil
+}
+
+// Sent by the server. Codecs frame these however they like; the binary codec
+// writes Type() and then AppendBinary.
+type ServerMessage interface {
+	Type() uint8
+	// Appends everything after the message type byte
+	AppendBinary(buffer []byte) []byte
+}
+
+// Sent by a client, as decoded by its connection's Codec.
+type ClientMessage interface {
+	Type() uint8
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerStateMessage
+// (FeatureLatency only) u16 rttMs;	0 until measured
+// (protocol 3 and up) u32 mapVersion;	of the map the state was simulated on
+// GameState;	keyframe or delta, quantized if negotiated
+// ]
+type stateMessage struct {
+	types.StateUpdate
+	RttMs      uint16 `json:"rttMs"`
+	MapVersion uint32 `json:"mapVersion"`
+
+	// Binary codec only
+	ProtocolVersion uint16 `json:"-"`
+	Quantized       bool   `json:"-"`
+	Latency         bool   `json:"-"`
+}
+
+func (message stateMessage) Type() uint8 { return ServerStateMessage }
+
+func (message stateMessage) AppendBinary(buffer []byte) []byte {
+	if message.Latency {
+		buffer = binary.BigEndian.AppendUint16(buffer, message.RttMs)
+	}
+	if message.ProtocolVersion >= 3 {
+		buffer = binary.BigEndian.AppendUint32(buffer, message.MapVersion)
+	}
+	if message.Quantized {
+		return message.StateUpdate.AppendQuantized(buffer)
+	}
+	return message.StateUpdate.AppendBinary(buffer)
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerMapMessage
+// u32 mapVersion;
+// MapLayout;
+// f64 playerSquareLengthTiles;
+// ]
+type mapMessage struct {
+	Version uint32
+	Layout  *types.MapLayout
+}
+
+func (message mapMessage) Type() uint8 { return ServerMapMessage }
+
+func (message mapMessage) AppendBinary(buffer []byte) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, message.Version)
+	buffer = message.Layout.AppendBinary(buffer)
+	buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(types.PLAYER_SQUARE_LENGTH_TILES))
+
+	return buffer
+}
+
+// Tiles are sent as one string per row, '#' for walls and '.' for floor, so
+// the map is readable in browser devtools.
+func (message mapMessage) MarshalJSON() ([]byte, error) {
+	rows := make([]string, message.Layout.Height)
+	for y := range rows {
+		row := make([]byte, message.Layout.Width)
+		for x := range row {
+			row[x] = '.'
+			if message.Layout.IsWall(x, y) {
+				row[x] = '#'
+			}
+		}
+		rows[y] = string(row)
+	}
+	return json.Marshal(struct {
+		Version                 uint32   `json:"version"`
+		Width                   uint32   `json:"width"`
+		Height                  uint32   `json:"height"`
+		Tiles                   []string `json:"tiles"`
+		PlayerSquareLengthTiles float64  `json:"playerSquareLengthTiles"`
+	}{
+		Version:                 message.Version,
+		Width:                   message.Layout.Width,
+		Height:                  message.Layout.Height,
+		Tiles:                   rows,
+		PlayerSquareLengthTiles: types.PLAYER_SQUARE_LENGTH_TILES,
+	})
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerWelcomeMessage
+// u16 protocolVersion;
+// u32 accepted feature flags;
+// ]
+type welcomeMessage struct {
+	ProtocolVersion uint16 `json:"protocolVersion"`
+	Features        uint32 `json:"features"`
+}
+
+func (message welcomeMessage) Type() uint8 { return ServerWelcomeMessage }
+
+func (message welcomeMessage) AppendBinary(buffer []byte) []byte {
+	buffer = binary.BigEndian.AppendUint16(buffer, message.ProtocolVersion)
+	buffer = binary.BigEndian.AppendUint32(buffer, message.Features)
+
+	return buffer
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerPlayerJoinedMessage
+// u32 uuidLength; string uuid;
+// ]
+type playerJoinedMessage struct {
+	Uuid string `json:"uuid"`
+}
+
+func (message playerJoinedMessage) Type() uint8 { return ServerPlayerJoinedMessage }
+
+func (message playerJoinedMessage) AppendBinary(buffer []byte) []byte {
+	return append(buffer, types.EncodeString(message.Uuid)...)
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerPlayerLeftMessage
+// u32 uuidLength; string uuid;
+// ]
+type playerLeftMessage struct {
+	Uuid string `json:"uuid"`
+}
+
+func (message playerLeftMessage) Type() uint8 { return ServerPlayerLeftMessage }
+
+func (message playerLeftMessage) AppendBinary(buffer []byte) []byte {
+	return append(buffer, types.EncodeString(message.Uuid)...)
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerKickedMessage
+// u32 reasonLength; string reason;
+// ]
+type kickedMessage struct {
+	Reason string `json:"reason"`
+}
+
+func (message kickedMessage) Type() uint8 { return ServerKickedMessage }
+
+func (message kickedMessage) AppendBinary(buffer []byte) []byte {
+	return append(buffer, types.EncodeString(message.Reason)...)
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerErrorMessage
+// u16 code;
+// u32 messageLength; string message;
+// ]
+type errorMessage struct {
+	Code   uint16 `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func newErrorMessage(err *ClientError) errorMessage {
+	return errorMessage{Code: err.Code, Reason: err.Reason}
+}
+
+func (message errorMessage) Type() uint8 { return ServerErrorMessage }
+
+func (message errorMessage) AppendBinary(buffer []byte) []byte {
+	buffer = binary.BigEndian.AppendUint16(buffer, message.Code)
+	buffer = append(buffer, types.EncodeString(message.Reason)...)
+
+	return buffer
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ServerSessionMessage
+// u32 tokenLength; string token;
+// u32 gracePeriodMs;	how long the player is kept after a disconnect
+// ]
+type sessionMessage struct {
+	Token         string `json:"token"`
+	GracePeriodMs uint32 `json:"gracePeriodMs"`
+}
+
+func (message sessionMessage) Type() uint8 { return ServerSessionMessage }
+
+func (message sessionMessage) AppendBinary(buffer []byte) []byte {
+	buffer = append(buffer, types.EncodeString(message.Token)...)
+	buffer = binary.BigEndian.AppendUint32(buffer, message.GracePeriodMs)
+
+	return buffer
+}
+
+// Sent before disconnecting a client that the server or its room has no room
+// for. The reason is meant to be shown to the player.
+//
+// ENCODING:
+// [
+// u8 messageType;	ServerFullMessage
+// u32 reasonLength; string reason;
+// ]
+type serverFullMessage struct {
+	Reason string `json:"reason"`
+}
+
+func (message serverFullMessage) Type() uint8 { return ServerFullMessage }
+
+func (message serverFullMessage) AppendBinary(buffer []byte) []byte {
+	return append(buffer, types.EncodeString(message.Reason)...)
+}
+
+// Sent instead of a playerJoined while the client waits for a full room, and
+// again whenever its place in the queue changes.
+//
+// ENCODING:
+// [
+// u8 messageType;	ServerQueuedMessage
+// u16 position;	1 for the next client to join
+// ]
+type queuedMessage struct {
+	Position uint16 `json:"position"`
+}
+
+func (message queuedMessage) Type() uint8 { return ServerQueuedMessage }
+
+func (message queuedMessage) AppendBinary(buffer []byte) []byte {
+	return binary.BigEndian.AppendUint16(buffer, message.Position)
+}
+
+// Confirms a spectate request, and is sent again when the followed player
+// leaves and the camera goes back to free.
+//
+// ENCODING:
+// [
+// u8 messageType;	ServerSpectatingMessage
+// u32 followLength; string follow;	uuid of the followed player, empty for a free camera
+// ]
+type spectatingMessage struct {
+	Follow string `json:"follow"`
+}
+
+func (message spectatingMessage) Type() uint8 { return ServerSpectatingMessage }
+
+func (message spectatingMessage) AppendBinary(buffer []byte) []byte {
+	return append(buffer, types.EncodeString(message.Follow)...)
+}
+
+// ENCODING:
+// [
+// u8 messageType;	ClientHelloMessage
+// u16 protocolVersion;
+// u32 requested feature flags;
+// ]
+type helloRequest struct {
+	ProtocolVersion uint16 `json:"protocolVersion"`
+	Features        uint32 `json:"features"`
+}
+
+func (request helloRequest) Type() uint8 { return ClientHelloMessage }
+
+// ENCODING:
+// [
+// u8 messageType;	ClientNewConnectionMessage
+// u32 uuidLength; string uuid;
+// (optional) u32 roomIdLength; string roomId;
+// (optional) u32 accessTokenLength; string accessToken;	needs roomId, which may be empty
+// ]
+type joinRequest struct {
+	// May be empty when an access token is given
+	Uuid string `json:"uuid"`
+	// Empty to stay in the room the client connected to
+	RoomId string `json:"roomId,omitempty"`
+	// Supabase access token, unless one was given when connecting
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+func (request joinRequest) Type() uint8 { return ClientNewConnectionMessage }
+
+// ENCODING:
+// [
+// u8 messageType;	ClientUpdateRequestMessage
+// PlayerSnapshot;
+// ]
+type playerUpdateRequest struct {
+	Snapshot types.PlayerSnapshot `json:"snapshot"`
+}
+
+func (request playerUpdateRequest) Type() uint8 { return ClientUpdateRequestMessage }
+
+// ENCODING:
+// [
+// u8 messageType;	ClientInputMessage
+// u32 sequence;	starting at 1
+// u8 keys;	directional key bitmask
+// ]
+type inputRequest struct {
+	Sequence uint32 `json:"sequence"`
+	Keys     uint8  `json:"keys"`
+}
+
+func (request inputRequest) Type() uint8 { return ClientInputMessage }
+
+// ENCODING:
+// [
+// u8 messageType;	ClientAckMessage
+// u64 serverTick;	of the newest snapshot received
+// ]
+type ackRequest struct {
+	Tick uint64 `json:"tick"`
+}
+
+func (request ackRequest) Type() uint8 { return ClientAckMessage }
+
+// The release's position is ignored; the particle spawns at the sender's player.
+//
+// ENCODING:
+// [
+// u8 messageType;	ClientReleaseParticleMessage
+// ParticleRelease;
+// ]
+type releaseParticleRequest struct {
+	Release types.ParticleRelease `json:"release"`
+}
+
+func (request releaseParticleRequest) Type() uint8 { return ClientReleaseParticleMessage }
+
+// Sent instead of a join to get back a disconnected player.
+//
+// ENCODING:
+// [
+// u8 messageType;	ClientResumeMessage
+// u32 tokenLength; string token;
+// ]
+type resumeRequest struct {
+	Token string `json:"token"`
+}
+
+func (request resumeRequest) Type() uint8 { return ClientResumeMessage }
+
+// Sent instead of a join to watch the room without a player. Spectators are
+// sent every player and particle regardless of line of sight. Sending it
+// again changes the followed player.
+//
+// ENCODING:
+// [
+// u8 messageType;	ClientSpectateMessage
+// u32 followLength; string follow;	uuid of the player to follow, empty for a free camera
+// (optional) u32 accessTokenLength; string accessToken;
+// ]
+type spectateRequest struct {
+	Follow      string `json:"follow"`
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+func (request spectateRequest) Type() uint8 { return ClientSpectateMessage }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// Largest frame a client may send. Join messages carrying an access token are
+// the biggest by far.
+const ConnectionMaxFrameBytes = 8 * 1024
+
+// Penalty at which a throttled client is sent a ServerErrorMessage warning
+const RateLimitWarnPenalty = 10
+
+// Penalty at which a throttled client is kicked
+const RateLimitKickPenalty = 50
+
+// Penalty forgiven per second
+const RateLimitPenaltyDecay = 2.0
+
+// Messages dropped and clients kicked for sending too fast, server wide.
+// Published at /debug/vars.
+var rateLimitDrops = expvar.NewInt("rateLimitDrops")
+var rateLimitKicks = expvar.NewInt("rateLimitKicks")
+
+type RateLimit struct {
+	PerSecond float64
+	Burst     float64
+}
+
+// Clients send an input, or a whole PlayerSnapshot, every animation frame, so
+// both are allowed at high refresh rates.
+func DefaultRateLimits() map[uint8]RateLimit {
+	return map[uint8]RateLimit{
+		ClientHelloMessage:           {PerSecond: 1, Burst: 2},
+		ClientNewConnectionMessage:   {PerSecond: 1, Burst: 3},
+		ClientResumeMessage:          {PerSecond: 1, Burst: 3},
+		ClientUpdateRequestMessage:   {PerSecond: 250, Burst: 250},
+		ClientInputMessage:           {PerSecond: 250, Burst: 250},
+		ClientAckMessage:             {PerSecond: 60, Burst: 30},
+		ClientReleaseParticleMessage: {PerSecond: 10, Burst: 20},
+		ClientSpectateMessage:        {PerSecond: 5, Burst: 10},
+	}
+}
+
+// Limit on all of a connection's messages together
+var DefaultConnectionRateLimit = RateLimit{PerSecond: 400, Burst: 400}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.Burst, last: now}
+}
+
+func (bucket *tokenBucket) take(now time.Time) bool {
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.last = now
+	bucket.tokens = min(bucket.limit.Burst, bucket.tokens+elapsed*bucket.limit.PerSecond)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// What to do with a client's message
+type rateVerdict int
+
+const (
+	rateAllow rateVerdict = iota
+	// Drop the message silently
+	rateDrop
+	// Drop the message and tell the client to slow down
+	rateWarn
+	// Drop the message and disconnect the client
+	rateKick
+)
+
+// Token buckets for one connection, per message type and overall. Each
+// dropped message adds to a penalty that decays over time; the response
+// escalates from dropping to warning to kicking as it grows.
+// Only used by the connection's reader goroutine.
+type RateLimiter struct {
+	overall *tokenBucket
+	perType map[uint8]*tokenBucket
+
+	penalty     float64
+	lastPenalty time.Time
+	warned      bool
+}
+
+func NewRateLimiter(limits map[uint8]RateLimit, overall RateLimit) *RateLimiter {
+	now := time.Now()
+	limiter := &RateLimiter{
+		overall:     newTokenBucket(overall, now),
+		perType:     map[uint8]*tokenBucket{},
+		lastPenalty: now,
+	}
+	for messageType, limit := range limits {
+		limiter.perType[messageType] = newTokenBucket(limit, now)
+	}
+	return limiter
+}
+
+func (limiter *RateLimiter) Check(messageType uint8, now time.Time) rateVerdict {
+	limiter.penalty = max(0, limiter.penalty-now.Sub(limiter.lastPenalty).Seconds()*RateLimitPenaltyDecay)
+	limiter.lastPenalty = now
+	if limiter.penalty == 0 {
+		limiter.warned = false
+	}
+
+	allowed := limiter.overall.take(now)
+	if bucket, exists := limiter.perType[messageType]; exists && allowed {
+		allowed = bucket.take(now)
+	}
+	if allowed {
+		return rateAllow
+	}
+
+	limiter.penalty++
+	switch {
+	case limiter.penalty >= RateLimitKickPenalty:
+		return rateKick
+	case limiter.penalty >= RateLimitWarnPenalty && !limiter.warned:
+		limiter.warned = true
+		return rateWarn
+	default:
+		return rateDrop
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rashrasa/blind-maze/apps/go-server/generation"
+	"github.com/rashrasa/blind-maze/apps/go-server/types"
+)
+
+const DefaultRoomId = "default"
+const MaxRoomIdLength = 64
+
+var ErrRoomExists = errors.New("room already exists")
+var ErrRoomNotFound = errors.New("room not found")
+var ErrInvalidRoomId = errors.New("invalid room id")
+var ErrRoomClosed = errors.New("room is closed")
+var ErrTooManyRooms = errors.New("too many rooms are open, try again later")
+
+const RoomCommandQueueSize = 256
+
+// Snapshots kept as delta baselines. At 20 snapshots per second this lets a
+// client's acks lag by a few seconds before it is sent keyframes again.
+const RoomSnapshotHistorySize = 64
+
+// What a room's tick loop knows about one of its connections.
+type roomClient struct {
+	uuid      string
+	ackedTick uint64
+	// Acks up to this tick are ignored, so the client is sent a keyframe
+	// even if acks for snapshots sent before it was snapped back arrive
+	keyframeAfterTick uint64
+
+	mapSent    bool
+	mapVersion uint32
+
+	// Spectators have no uuid and see everything
+	spectating bool
+	// Player a spectator's camera follows, empty for a free camera
+	follow string
+	// Resume token issued to the connection, if any
+	sessionToken string
+}
+
+// A single match. Owns its own game state, connection set and tick loop.
+//
+// The game state is only ever touched by the tick loop goroutine. Connection
+// goroutines describe what they want done with a roomCommand instead.
+type Room struct {
+	Id          string
+	gameState   *types.GameState
+	connections []*Connection
+	closed      bool
+	commands    chan roomCommand
+	clients     map[*Connection]*roomClient
+	movement    map[string]*movementTracker
+	waiting     []joinCommand
+	history     *types.SnapshotHistory
+	mapVersion  uint32
+	mapFrames   map[Codec][]byte
+	config      RoomConfig
+	scheduler   *Scheduler
+	sessions    *SessionStore
+	_lock       *sync.RWMutex
+	_stop       chan struct{}
+	_stopOnce   *sync.Once
+}
+
+type RoomConfig struct {
+	Scheduler SchedulerConfig
+	Interest  types.Interest
+	// Most players at once, 0 for unlimited
+	MaxPlayers int
+	// Most joins waiting for a place once the room is full
+	QueueSize int
+}
+
+func NewRoom(id string, config RoomConfig, sessions *SessionStore) *Room {
+	room := &Room{
+		Id:        id,
+		gameState: new(types.GameState),
+		commands:  make(chan roomCommand, RoomCommandQueueSize),
+		clients:   map[*Connection]*roomClient{},
+		movement:  map[string]*movementTracker{},
+		history:   types.NewSnapshotHistory(RoomSnapshotHistorySize),
+		config:    config,
+		scheduler: NewScheduler(config.Scheduler),
+		sessions:  sessions,
+		_lock:     new(sync.RWMutex),
+		_stop:     make(chan struct{}),
+		_stopOnce: new(sync.Once),
+	}
+	room.setMapLayout(generation.GenerateMap())
+
+	return room
+}
+
+// Replaces the map. Clients are sent the new one before their next snapshot.
+// Must only be called from the tick loop once it has started.
+func (room *Room) setMapLayout(layout types.MapLayout) {
+	room.gameState.MapLayout = layout
+	room.mapVersion = layout.Version()
+	room.mapFrames = map[Codec][]byte{}
+}
+
+// Map message encoded with the codec, cached until the map changes.
+// Must only be called from the tick loop.
+func (room *Room) mapFrame(codec Codec) ([]byte, error) {
+	if frame, exists := room.mapFrames[codec]; exists {
+		return frame, nil
+	}
+	frame, err := codec.Encode(mapMessage{Version: room.mapVersion, Layout: &room.gameState.MapLayout})
+	if err != nil {
+		return nil, err
+	}
+	room.mapFrames[codec] = frame
+	return frame, nil
+}
+
+// Adds the connection to the set that receives this room's updates.
+func (room *Room) AddConnection(connection *Connection) error {
+	room._lock.Lock()
+	defer room._lock.Unlock()
+
+	if room.closed {
+		return ErrRoomClosed
+	}
+	connection.room = room
+	room.connections = append(room.connections, connection)
+	return nil
+}
+
+// Removes the connection from the room and queues removal of its player.
+// Returns: number of connections left in the room
+func (room *Room) RemoveConnection(connection *Connection) int {
+	return room.removeConnection(connection, false)
+}
+
+// Removes the connection from the room but keeps its player for a resume.
+// Returns: number of connections left in the room
+func (room *Room) DetachConnection(connection *Connection) int {
+	return room.removeConnection(connection, true)
+}
+
+func (room *Room) removeConnection(connection *Connection, keepPlayer bool) int {
+	room._lock.Lock()
+	for i, c := range room.connections {
+		if c == connection {
+			// Removes item i
+			room.connections = append(room.connections[:i], room.connections[i+1:]...)
+			break
+		}
+	}
+	remaining := len(room.connections)
+	room._lock.Unlock()
+
+	room.Send(leaveCommand{connection: connection, keepPlayer: keepPlayer})
+
+	return remaining
+}
+
+// Must only be called from the tick loop.
+func (room *Room) spawnPlayer(connection *Connection, uuid string) {
+	room.gameState.PlayerStates = append(room.gameState.PlayerStates, &types.PlayerSnapshot{
+		Uuid:                uuid,
+		Position:            types.Vector2[float64]{X: 1.8, Y: 1.8},
+		Velocity:            types.Vector2[float64]{X: 0, Y: 0},
+		IsLeader:            false,
+		SnapshotTimestampMs: uint64(time.Now().UnixMilli()),
+	})
+	room.client(connection).uuid = uuid
+	room.broadcast(playerJoinedMessage{Uuid: uuid})
+
+	log.Print("Player joined room " + room.Id + ". Players: " + fmt.Sprint(len(room.gameState.PlayerStates)))
+}
+
+// Must only be called from the tick loop.
+func (room *Room) removePlayer(uuid string) {
+	for j, player := range room.gameState.PlayerStates {
+		if player.Uuid == uuid {
+			// Removes item j
+			room.gameState.PlayerStates = append(room.gameState.PlayerStates[:j], room.gameState.PlayerStates[j+1:]...)
+			delete(room.movement, uuid)
+			room.broadcast(playerLeftMessage{Uuid: uuid})
+			room.unfollow(uuid)
+			break
+		}
+	}
+	room.admitWaiting()
+}
+
+// Gives the connection a resume token for its player if it negotiated
+// FeatureSessionResume. Tokens are only issued once the player is in the game.
+// Must only be called from the tick loop.
+func (room *Room) issueSession(connection *Connection, uuid string) {
+	if !connection.Supports(FeatureSessionResume) {
+		return
+	}
+	room.sendSession(connection, room.sessions.Create(room.Id, uuid, connection))
+}
+
+// Must only be called from the tick loop.
+func (room *Room) sendSession(connection *Connection, token string) {
+	room.client(connection).sessionToken = token
+	connection.setSessionToken(token)
+	connection.QueueMessage(sessionMessage{
+		Token:         token,
+		GracePeriodMs: uint32(SessionGracePeriod.Milliseconds()),
+	})
+}
+
+// Gives a connection the player of a detached session, along with the
+// session so its expiry no longer removes the player. Connections that did
+// not negotiate FeatureSessionResume cannot resume it, so the session ends.
+// Must only be called from the tick loop.
+func (room *Room) takeOverPlayer(connection *Connection, uuid string) {
+	room.client(connection).uuid = uuid
+	session, claimed := room.sessions.ClaimPlayer(room.Id, uuid, connection)
+	switch {
+	case !claimed:
+		room.issueSession(connection, uuid)
+	case connection.Supports(FeatureSessionResume):
+		room.sendSession(connection, session.Token)
+	default:
+		room.sessions.Revoke(session.Token, connection)
+	}
+
+	log.Print("Player " + uuid + " taken over by a join in room " + room.Id)
+}
+
+// Whether a connection is playing the player.
+// Must only be called from the tick loop.
+func (room *Room) playing(uuid string) bool {
+	for _, client := range room.clients {
+		if client.uuid == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a spectator is signed in as the user.
+// Must only be called from the tick loop.
+func (room *Room) spectating(userId string) bool {
+	for connection, client := range room.clients {
+		if client.spectating && connection.userId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// Frees the camera of every spectator following the player.
+// Must only be called from the tick loop.
+func (room *Room) unfollow(uuid string) {
+	for connection, client := range room.clients {
+		if client.spectating && client.follow == uuid {
+			client.follow = ""
+			connection.QueueMessage(spectatingMessage{})
+		}
+	}
+}
+
+// Must only be called from the tick loop.
+func (room *Room) full() bool {
+	return room.config.MaxPlayers != 0 && len(room.gameState.PlayerStates) >= room.config.MaxPlayers
+}
+
+// Lets queued joins in while the room has space, then tells the rest where
+// they now stand.
+// Must only be called from the tick loop.
+func (room *Room) admitWaiting() {
+	if len(room.waiting) == 0 || room.full() {
+		return
+	}
+	for len(room.waiting) > 0 && !room.full() {
+		command := room.waiting[0]
+		room.waiting = room.waiting[1:]
+		command.apply(room)
+	}
+	room.sendQueuePositions()
+}
+
+// Must only be called from the tick loop.
+func (room *Room) sendQueuePositions() {
+	for i, command := range room.waiting {
+		command.connection.QueueMessage(queuedMessage{Position: uint16(i + 1)})
+	}
+}
+
+// Queues a command for the tick loop. Returns false if the room is closed.
+func (room *Room) Send(command roomCommand) bool {
+	select {
+	case room.commands <- command:
+		return true
+	case <-room._stop:
+		return false
+	}
+}
+
+func (room *Room) Len() int {
+	room._lock.RLock()
+	defer room._lock.RUnlock()
+
+	return len(room.connections)
+}
+
+func (room *Room) Connections() []*Connection {
+	room._lock.RLock()
+	defer room._lock.RUnlock()
+
+	return append([]*Connection{}, room.connections...)
+}
+
+// Queues a discrete message for every connection in the room that has been
+// welcomed, encoding it once per codec.
+func (room *Room) broadcast(message ServerMessage) {
+	frames := map[Codec][]byte{}
+	for _, connection := range room.Connections() {
+		if connection.ProtocolVersion() == 0 {
+			// Nothing is sent before the welcome
+			continue
+		}
+		frame, encoded := frames[connection.codec]
+		if !encoded {
+			var err error
+			if frame, err = connection.Encode(message); err != nil {
+				log.Print("Could not encode broadcast for room " + room.Id + ". Error: " + err.Error())
+				return
+			}
+			frames[connection.codec] = frame
+		}
+		connection.QueueFrame(frame)
+	}
+}
+
+// Must only be called from the tick loop.
+func (room *Room) client(connection *Connection) *roomClient {
+	client, exists := room.clients[connection]
+	if !exists {
+		client = &roomClient{}
+		room.clients[connection] = client
+	}
+	return client
+}
+
+// Commands from a connection act on the player the tick loop gave it, not on
+// the uuid it asked for, which may have been refused or still be queued.
+// Returns: the connection's player, nil if it has none
+// Must only be called from the tick loop.
+func (room *Room) playerOf(connection *Connection) *types.PlayerSnapshot {
+	client, exists := room.clients[connection]
+	if !exists || client.uuid == "" {
+		return nil
+	}
+	return room.gameState.FindPlayer(client.uuid)
+}
+
+// Sends each client the changes it can see since the last snapshot it
+// acknowledged.
+// Must only be called from the tick loop.
+func (room *Room) updateAllClients() {
+	// Every snapshot for a tick must match the recorded baseline
+	if latest, exists := room.history.Latest(); exists && latest == room.gameState.TickNumber {
+		return
+	}
+	room.history.Add(room.gameState.Capture())
+
+	for _, connection := range room.Connections() {
+		version := connection.ProtocolVersion()
+		if version == 0 {
+			// Nothing is sent before the welcome
+			continue
+		}
+		client := room.client(connection)
+		if !client.mapSent || client.mapVersion != room.mapVersion {
+			// Discrete messages are written before any queued snapshot
+			frame, err := room.mapFrame(connection.codec)
+			if err != nil {
+				log.Print("Could not encode map for " + connection.address + ". Error: " + err.Error())
+				continue
+			}
+			connection.QueueFrame(frame)
+			client.mapSent = true
+			client.mapVersion = room.mapVersion
+		}
+
+		// Baselines are filtered the same way so deltas only mention what
+		// the client was actually sent
+		var baseline *types.StateSnapshot
+		if client.ackedTick != 0 {
+			if recorded := room.history.Get(client.ackedTick); recorded != nil {
+				baseline = recorded
+				if !client.spectating {
+					baseline = recorded.VisibleTo(client.uuid, &room.gameState.MapLayout, room.config.Interest)
+				}
+			}
+		}
+		visible := room.gameState
+		if !client.spectating {
+			visible = room.gameState.VisibleTo(client.uuid, room.config.Interest)
+		}
+		// Rounded up so a measured round trip is never reported as 0
+		rttMs := min((connection.RTT()+time.Millisecond-1)/time.Millisecond, math.MaxUint16)
+		// Read once so the snapshot is queued only if the handshake has not
+		// changed them meanwhile
+		features := connection.Features()
+		frame, err := connection.Encode(stateMessage{
+			StateUpdate:     visible.Update(client.uuid, baseline),
+			RttMs:           uint16(rttMs),
+			MapVersion:      room.mapVersion,
+			ProtocolVersion: version,
+			Quantized:       features&FeatureQuantizedSnapshots != 0,
+			Latency:         features&FeatureLatency != 0,
+		})
+		if err != nil {
+			log.Print("Could not encode snapshot for " + connection.address + ". Error: " + err.Error())
+			continue
+		}
+		connection.QueueSnapshot(frame, features)
+	}
+}
+
+func (room *Room) startTickCycle() {
+	tickTicker := time.NewTicker(room.config.Scheduler.TickInterval())
+	defer tickTicker.Stop()
+	snapshotTicker := time.NewTicker(room.config.Scheduler.SnapshotInterval())
+	defer snapshotTicker.Stop()
+
+	overruns := room.scheduler.Overruns()
+	for {
+		select {
+		case <-room._stop:
+			return
+		case command := <-room.commands:
+			command.apply(room)
+		case now := <-tickTicker.C:
+			room.scheduler.Advance(now, room.gameState.Tick)
+			if latest := room.scheduler.Overruns(); latest != overruns {
+				log.Print("Room " + room.Id + " fell behind, skipped " + fmt.Sprint(latest-overruns) + " ticks")
+				overruns = latest
+			}
+		case <-snapshotTicker.C:
+			room.updateAllClients()
+		}
+	}
+}
+
+type RoomStats struct {
+	Connections  int
+	Ticks        uint64
+	TickOverruns uint64
+	// Mean round trip time of clients that have answered a ping
+	MeanRttMs float64
+	// Messages dropped by the rate limiter, by client address. Only clients
+	// that have been throttled are listed. Stats are only served on the admin
+	// listener, so addresses are not exposed publicly.
+	Throttled map[string]uint64
+	// Open connections that have had messages dropped by the rate limiter
+	ThrottledConnections int
+	// Messages those connections have had dropped
+	ThrottledMessages uint64
+}
+
+func (room *Room) Stats() RoomStats {
+	stats := RoomStats{
+		Ticks:        room.scheduler.Ticks(),
+		TickOverruns: room.scheduler.Overruns(),
+		Throttled:    map[string]uint64{},
+	}
+	measured := 0
+	for _, connection := range room.Connections() {
+		stats.Connections++
+		if throttled := connection.throttled.Load(); throttled > 0 {
+			stats.Throttled[connection.address] = throttled
+			stats.ThrottledConnections++
+			stats.ThrottledMessages += throttled
+		}
+		if rtt := connection.RTT(); rtt > 0 {
+			stats.MeanRttMs += float64(rtt) / float64(time.Millisecond)
+			measured++
+		}
+	}
+	if measured > 0 {
+		stats.MeanRttMs /= float64(measured)
+	}
+	return stats
+}
+
+// Stops the tick loop and disconnects every client in the room.
+func (room *Room) Close() {
+	room._stopOnce.Do(func() {
+		room._lock.Lock()
+		room.closed = true
+		room._lock.Unlock()
+
+		close(room._stop)
+		for _, connection := range room.Connections() {
+			connection.Evict("room closed")
+		}
+	})
+}
+
+// Creates, looks up and closes rooms.
+type RoomRegistry struct {
+	rooms    map[string]*Room
+	config   RoomConfig
+	maxRooms int
+	sessions *SessionStore
+	_lock    *sync.RWMutex
+}
+
+// A maxRooms of 0 means unlimited.
+func NewRoomRegistry(config RoomConfig, maxRooms int) *RoomRegistry {
+	registry := &RoomRegistry{
+		rooms:    map[string]*Room{},
+		config:   config,
+		maxRooms: maxRooms,
+		_lock:    new(sync.RWMutex),
+	}
+	registry.sessions = NewSessionStore(registry.expireSession)
+	return registry
+}
+
+func (registry *RoomRegistry) expireSession(session Session) {
+	if room, exists := registry.Get(session.RoomId); exists {
+		room.Send(expireSessionCommand{uuid: session.Uuid})
+		log.Print("Session of player " + session.Uuid + " in room " + session.RoomId + " expired")
+	}
+	registry.CloseIfEmpty(session.RoomId)
+}
+
+func ValidateRoomId(id string) error {
+	if id == "" || len(id) > MaxRoomIdLength {
+		return ErrInvalidRoomId
+	}
+	return nil
+}
+
+// Creates a room and starts its tick loop, unless maxRooms are already open.
+func (registry *RoomRegistry) Create(id string) (*Room, error) {
+	if err := ValidateRoomId(id); err != nil {
+		return nil, err
+	}
+	registry._lock.Lock()
+	defer registry._lock.Unlock()
+
+	if _, exists := registry.rooms[id]; exists {
+		return nil, ErrRoomExists
+	}
+	if registry.maxRooms != 0 && len(registry.rooms) >= registry.maxRooms {
+		return nil, ErrTooManyRooms
+	}
+	room := NewRoom(id, registry.config, registry.sessions)
+	registry.rooms[id] = room
+	go room.startTickCycle()
+
+	log.Print("Created room " + id)
+	return room, nil
+}
+
+func (registry *RoomRegistry) Get(id string) (*Room, bool) {
+	registry._lock.RLock()
+	defer registry._lock.RUnlock()
+
+	room, exists := registry.rooms[id]
+	return room, exists
+}
+
+func (registry *RoomRegistry) GetOrCreate(id string) (*Room, error) {
+	if room, exists := registry.Get(id); exists {
+		return room, nil
+	}
+	room, err := registry.Create(id)
+	if errors.Is(err, ErrRoomExists) {
+		// Created concurrently
+		room, _ = registry.Get(id)
+		return room, nil
+	}
+	return room, err
+}
+
+// Adds the connection to the room with the given id, creating the room if needed.
+func (registry *RoomRegistry) Join(id string, connection *Connection) (*Room, error) {
+	room, err := registry.GetOrCreate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Holding the read lock keeps CloseIfEmpty from closing the room mid-join
+	registry._lock.RLock()
+	defer registry._lock.RUnlock()
+
+	if registry.rooms[id] != room {
+		return nil, ErrRoomClosed
+	}
+	return room, room.AddConnection(connection)
+}
+
+// Closes the room if nobody is connected to it and no player is waiting to be
+// resumed. The default room is never closed.
+func (registry *RoomRegistry) CloseIfEmpty(id string) bool {
+	if id == DefaultRoomId {
+		return false
+	}
+	registry._lock.Lock()
+	room, exists := registry.rooms[id]
+	if !exists || room.Len() > 0 || registry.sessions.InRoom(id) {
+		registry._lock.Unlock()
+		return false
+	}
+	delete(registry.rooms, id)
+	registry._lock.Unlock()
+
+	room.Close()
+	log.Print("Closed empty room " + id)
+	return true
+}
+
+func (registry *RoomRegistry) Close(id string) error {
+	registry._lock.Lock()
+	room, exists := registry.rooms[id]
+	delete(registry.rooms, id)
+	registry._lock.Unlock()
+
+	if !exists {
+		return ErrRoomNotFound
+	}
+	room.Close()
+
+	log.Print("Closed room " + id)
+	return nil
+}
+
+func (registry *RoomRegistry) Len() int {
+	registry._lock.RLock()
+	defer registry._lock.RUnlock()
+
+	return len(registry.rooms)
+}
+
+// Stats of every open room, keyed by room id. Published at /debug/vars.
+func (registry *RoomRegistry) Stats() any {
+	registry._lock.RLock()
+	defer registry._lock.RUnlock()
+
+	stats := map[string]RoomStats{}
+	for id, room := range registry.rooms {
+		stats[id] = room.Stats()
+	}
+	return stats
+}
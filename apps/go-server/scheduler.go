@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultTickRate = 60
+const DefaultSnapshotRate = 20
+const DefaultMaxCatchUpTicks = 5
+
+type SchedulerConfig struct {
+	// Simulation ticks per second
+	TickRate int
+	// Snapshots sent to clients per second
+	SnapshotRate int
+	// Most ticks run back to back after the loop falls behind.
+	// Any further backlog is dropped and counted as overruns.
+	MaxCatchUpTicks int
+}
+
+func DefaultSchedulerConfig() SchedulerConfig {
+	return SchedulerConfig{
+		TickRate:        DefaultTickRate,
+		SnapshotRate:    DefaultSnapshotRate,
+		MaxCatchUpTicks: DefaultMaxCatchUpTicks,
+	}
+}
+
+// Reads BLIND_MAZE_TICK_RATE, BLIND_MAZE_SNAPSHOT_RATE and
+// BLIND_MAZE_MAX_CATCH_UP_TICKS, keeping defaults for unset values.
+func SchedulerConfigFromEnv() (SchedulerConfig, error) {
+	config := DefaultSchedulerConfig()
+
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{
+		{"BLIND_MAZE_TICK_RATE", &config.TickRate},
+		{"BLIND_MAZE_SNAPSHOT_RATE", &config.SnapshotRate},
+		{"BLIND_MAZE_MAX_CATCH_UP_TICKS", &config.MaxCatchUpTicks},
+	} {
+		raw := os.Getenv(setting.key)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return config, fmt.Errorf("%s: %w", setting.key, err)
+		}
+		*setting.value = parsed
+	}
+
+	return config, config.Validate()
+}
+
+func (config SchedulerConfig) Validate() error {
+	if config.TickRate <= 0 || config.TickRate > 1000 {
+		return errors.New("tick rate must be between 1 and 1000")
+	}
+	if config.SnapshotRate <= 0 || config.SnapshotRate > config.TickRate {
+		return errors.New("snapshot rate must be between 1 and the tick rate")
+	}
+	if config.MaxCatchUpTicks <= 0 {
+		return errors.New("max catch up ticks must be positive")
+	}
+	return nil
+}
+
+func (config SchedulerConfig) TickInterval() time.Duration {
+	return time.Second / time.Duration(config.TickRate)
+}
+
+func (config SchedulerConfig) SnapshotInterval() time.Duration {
+	return time.Second / time.Duration(config.SnapshotRate)
+}
+
+// Fixed timestep accumulator. Runs however many ticks of TickInterval fit in
+// the time since the last call, up to MaxCatchUpTicks.
+type Scheduler struct {
+	config      SchedulerConfig
+	lastAdvance time.Time
+	accumulated time.Duration
+
+	ticks    atomic.Uint64
+	overruns atomic.Uint64
+}
+
+func NewScheduler(config SchedulerConfig) *Scheduler {
+	return &Scheduler{
+		config:      config,
+		lastAdvance: time.Now(),
+	}
+}
+
+// Returns: number of ticks run
+func (scheduler *Scheduler) Advance(now time.Time, tick func(durationMs float64)) int {
+	interval := scheduler.config.TickInterval()
+	durationMs := float64(interval) / float64(time.Millisecond)
+
+	scheduler.accumulated += now.Sub(scheduler.lastAdvance)
+	scheduler.lastAdvance = now
+
+	run := 0
+	for scheduler.accumulated >= interval && run < scheduler.config.MaxCatchUpTicks {
+		tick(durationMs)
+		scheduler.accumulated -= interval
+		run++
+	}
+	scheduler.ticks.Add(uint64(run))
+
+	// Too far behind to catch up. Drop the backlog rather than spiral.
+	if scheduler.accumulated >= interval {
+		scheduler.overruns.Add(uint64(scheduler.accumulated / interval))
+		scheduler.accumulated %= interval
+	}
+
+	return run
+}
+
+// Simulation ticks run so far
+func (scheduler *Scheduler) Ticks() uint64 {
+	return scheduler.ticks.Load()
+}
+
+// Simulation ticks skipped because the loop fell too far behind
+func (scheduler *Scheduler) Overruns() uint64 {
+	return scheduler.overruns.Load()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// How long a disconnected player is kept for its client to resume
+const SessionGracePeriod = 30 * time.Second
+
+// A player that can be reclaimed with its resume token.
+type Session struct {
+	Token  string
+	RoomId string
+	Uuid   string
+
+	// nil while detached
+	connection *Connection
+	// Bumped on every detach so a stale expiry timer does nothing
+	detachCount uint64
+}
+
+// Resume tokens of every joined player whose client asked for them.
+type SessionStore struct {
+	sessions map[string]*Session
+	// Called once a detached session's grace period runs out
+	onExpire func(session Session)
+	_lock    *sync.Mutex
+}
+
+func NewSessionStore(onExpire func(session Session)) *SessionStore {
+	return &SessionStore{
+		sessions: map[string]*Session{},
+		onExpire: onExpire,
+		_lock:    new(sync.Mutex),
+	}
+}
+
+// Returns: the resume token for the player
+func (store *SessionStore) Create(roomId string, uuid string, connection *Connection) string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+
+	store._lock.Lock()
+	defer store._lock.Unlock()
+
+	store.sessions[token] = &Session{Token: token, RoomId: roomId, Uuid: uuid, connection: connection}
+	return token
+}
+
+// Attaches a new connection to the session. A connection still attached is
+// returned so it can be disconnected; it has usually not noticed it is dead.
+// Sessions of other players cannot be claimed when owner is not empty.
+// Returns: the session; the previous connection, if any; false if the token is unknown, expired, revoked or not the owner's
+func (store *SessionStore) Claim(token string, owner string, connection *Connection) (Session, *Connection, bool) {
+	store._lock.Lock()
+	defer store._lock.Unlock()
+
+	session, exists := store.sessions[token]
+	if !exists || (owner != "" && session.Uuid != owner) {
+		return Session{}, nil, false
+	}
+	if session.connection != nil && session.connection.Kicked() {
+		// Revoked as soon as the kicked connection finishes disconnecting
+		return Session{}, nil, false
+	}
+	previous := session.connection
+	session.connection = connection
+	return *session, previous, true
+}
+
+// Attaches the connection to the player's session if it is detached, for a
+// join that takes over the player during its grace period.
+// Returns: the session; false if the player has no detached session
+func (store *SessionStore) ClaimPlayer(roomId string, uuid string, connection *Connection) (Session, bool) {
+	store._lock.Lock()
+	defer store._lock.Unlock()
+
+	for _, session := range store.sessions {
+		if session.RoomId == roomId && session.Uuid == uuid && session.connection == nil {
+			session.connection = connection
+			return *session, true
+		}
+	}
+	return Session{}, false
+}
+
+// Forgets the session if the connection still owns it, so its player can no
+// longer be resumed.
+func (store *SessionStore) Revoke(token string, connection *Connection) {
+	store._lock.Lock()
+	defer store._lock.Unlock()
+
+	if session, exists := store.sessions[token]; exists && session.connection == connection {
+		delete(store.sessions, token)
+	}
+}
+
+// Starts the grace period if the connection still owns the session.
+// Returns: whether the session's player should be kept
+func (store *SessionStore) Detach(token string, connection *Connection) bool {
+	store._lock.Lock()
+	defer store._lock.Unlock()
+
+	session, exists := store.sessions[token]
+	if !exists {
+		return false
+	}
+	if session.connection != connection {
+		// Another connection has already resumed it
+		return true
+	}
+	session.connection = nil
+	session.detachCount++
+	detachCount := session.detachCount
+	time.AfterFunc(SessionGracePeriod, func() {
+		store.expire(token, detachCount)
+	})
+	return true
+}
+
+func (store *SessionStore) expire(token string, detachCount uint64) {
+	store._lock.Lock()
+	session, exists := store.sessions[token]
+	if !exists || session.connection != nil || session.detachCount != detachCount {
+		store._lock.Unlock()
+		return
+	}
+	delete(store.sessions, token)
+	store._lock.Unlock()
+
+	store.onExpire(*session)
+}
+
+// Whether any session belongs to the room, attached or not
+func (store *SessionStore) InRoom(roomId string) bool {
+	store._lock.Lock()
+	defer store._lock.Unlock()
+
+	for _, session := range store.sessions {
+		if session.RoomId == roomId {
+			return true
+		}
+	}
+	return false
+}
@@ -1,3 +1,8 @@
+// Binary encoders and decoders for PlayerSnapshot, Particle, ParticleRelease
+// and MapLayout are generated from schema/codec.json, along with their
+// TypeScript equivalents.
+//
+//go:generate go run ../cmd/codecgen -schema ../schema/codec.json -go codec_gen.go -ts ../../../packages/types/codec.gen.ts
 package types
 
 import (
@@ -5,8 +10,8 @@ import (
 )
 
 type Vector2[T any] struct {
-	X T
-	Y T
+	X T `json:"x"`
+	Y T `json:"y"`
 }
 
 // u32 length; string;
@@ -21,7 +26,11 @@ func EncodeString(s string) []byte {
 
 // u32 length; string;
 // Returns: string; total bytes traversed
-func DecodeString(p []byte) (string, uint32) {
-	length := binary.BigEndian.Uint32(p[0:4])
-	return string(p[4 : length+4]), (length + 4)
+func DecodeString(p []byte) (string, uint32, error) {
+	decoder := NewDecoder(p)
+	s := decoder.String("string")
+	if err := decoder.Err(); err != nil {
+		return "", 0, err
+	}
+	return s, uint32(decoder.Offset()), nil
 }
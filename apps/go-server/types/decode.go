@@ -0,0 +1,167 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Longest string any decoder accepts, in bytes
+const MAX_STRING_LENGTH = 1024
+
+// Largest map width or height any decoder accepts, in tiles
+const MAX_MAP_SIDE_TILES = 4096
+
+var ErrTruncated = errors.New("truncated input")
+var ErrStringTooLong = errors.New("string too long")
+var ErrTrailingBytes = errors.New("trailing bytes")
+var ErrInvalidValue = errors.New("invalid value")
+
+// Where decoding failed and why. Unwraps to one of the Err* values above.
+type DecodeError struct {
+	Field  string
+	Offset int
+	Err    error
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("decoding %s at byte %d: %s", err.Field, err.Offset, err.Err.Error())
+}
+
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+// Reads big-endian fields from a buffer, remembering the first error.
+// Every read after an error is a no-op returning a zero value.
+type Decoder struct {
+	p      []byte
+	offset int
+	err    error
+}
+
+func NewDecoder(p []byte) *Decoder {
+	return &Decoder{p: p}
+}
+
+func (decoder *Decoder) fail(field string, err error) {
+	if decoder.err == nil {
+		decoder.err = &DecodeError{Field: field, Offset: decoder.offset, Err: err}
+	}
+}
+
+// Returns: the next n bytes, or nil if there are fewer left
+func (decoder *Decoder) take(field string, n int) []byte {
+	if decoder.err != nil {
+		return nil
+	}
+	if n < 0 || len(decoder.p)-decoder.offset < n {
+		decoder.fail(field, ErrTruncated)
+		return nil
+	}
+	taken := decoder.p[decoder.offset : decoder.offset+n]
+	decoder.offset += n
+	return taken
+}
+
+func (decoder *Decoder) Uint8(field string) uint8 {
+	if b := decoder.take(field, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// Accepts only 0 or 1
+func (decoder *Decoder) Bool(field string) bool {
+	b := decoder.Uint8(field)
+	if b > 1 {
+		decoder.offset--
+		decoder.fail(field, ErrInvalidValue)
+		return false
+	}
+	return b == 1
+}
+
+func (decoder *Decoder) Uint16(field string) uint16 {
+	if b := decoder.take(field, 2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (decoder *Decoder) Uint32(field string) uint32 {
+	if b := decoder.take(field, 4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (decoder *Decoder) Uint64(field string) uint64 {
+	if b := decoder.take(field, 8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (decoder *Decoder) Float64(field string) float64 {
+	return math.Float64frombits(decoder.Uint64(field))
+}
+
+// u32 length; string;
+func (decoder *Decoder) String(field string) string {
+	start := decoder.offset
+	length := decoder.Uint32(field)
+	if decoder.err != nil {
+		return ""
+	}
+	if length > MAX_STRING_LENGTH {
+		decoder.offset = start
+		decoder.fail(field, ErrStringTooLong)
+		return ""
+	}
+	return string(decoder.take(field, int(length)))
+}
+
+// Rows of ceil(width / 8) bytes, one bit per tile
+func (decoder *Decoder) BitGrid(field string, width uint32, height uint32) [][]byte {
+	rowLength := (uint64(width) + 7) / 8
+	if decoder.err != nil {
+		return nil
+	}
+	if width > MAX_MAP_SIDE_TILES || height > MAX_MAP_SIDE_TILES || (width == 0 && height != 0) {
+		decoder.fail(field, ErrInvalidValue)
+		return nil
+	}
+	if rowLength*uint64(height) > uint64(decoder.Remaining()) {
+		decoder.fail(field, ErrTruncated)
+		return nil
+	}
+	rows := make([][]byte, height)
+	for y := range rows {
+		rows[y] = append([]byte{}, decoder.take(field, int(rowLength))...)
+	}
+	return rows
+}
+
+// Bytes read so far
+func (decoder *Decoder) Offset() int {
+	return decoder.offset
+}
+
+func (decoder *Decoder) Remaining() int {
+	return len(decoder.p) - decoder.offset
+}
+
+// The first error, or ErrTrailingBytes if input is left over.
+func (decoder *Decoder) Finish() error {
+	if decoder.err == nil && decoder.Remaining() > 0 {
+		decoder.fail("end of message", ErrTrailingBytes)
+	}
+	return decoder.err
+}
+
+// The first error, ignoring any input left over.
+func (decoder *Decoder) Err() error {
+	return decoder.err
+}
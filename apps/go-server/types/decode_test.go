@@ -0,0 +1,161 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func FuzzDecodeString(f *testing.F) {
+	f.Add(EncodeString(""))
+	f.Add(EncodeString("00000000-0000-0000-0000-000000000000"))
+	f.Add([]byte{0, 0, 0, 5, 'a'})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		s, traversed, err := DecodeString(p)
+		if err != nil {
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("error is not a *DecodeError: %v", err)
+			}
+			return
+		}
+		if int(traversed) > len(p) {
+			t.Fatalf("traversed %d bytes of %d", traversed, len(p))
+		}
+		if !bytes.Equal(EncodeString(s), p[:traversed]) {
+			t.Fatalf("%q does not re-encode to its input", s)
+		}
+	})
+}
+
+func FuzzParticleFromBinary(f *testing.F) {
+	valid := (&Particle{
+		Id:         7,
+		Position:   Vector2[float64]{X: 1.5, Y: 2.5},
+		Velocity:   Vector2[float64]{X: -3, Y: 4},
+		TimeLeftMs: 5000,
+	}).ToBinary()
+	f.Add(valid)
+	f.Add(valid[:20])
+	f.Add(append(valid, 0))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		particle, err := ParticleFromBinary(p)
+		if err != nil {
+			if !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrTrailingBytes) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return
+		}
+		if !bytes.Equal(particle.ToBinary(), p) {
+			t.Fatalf("particle does not re-encode to its input")
+		}
+	})
+}
+
+func FuzzParticleReleaseFromBinary(f *testing.F) {
+	valid := (&ParticleRelease{
+		Position:   Vector2[float64]{X: 1.5, Y: 2.5},
+		Velocity:   Vector2[float64]{X: -3, Y: 4},
+		TimeLeftMs: 5000,
+	}).ToBinary()
+	f.Add(valid)
+	f.Add(valid[:20])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		release, err := ParticleReleaseFromBinary(p)
+		if err != nil {
+			if !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrTrailingBytes) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return
+		}
+		if !bytes.Equal(release.ToBinary(), p) {
+			t.Fatalf("particle release does not re-encode to its input")
+		}
+	})
+}
+
+func FuzzMapLayoutFromBinary(f *testing.F) {
+	valid := (&MapLayout{
+		Width:  10,
+		Height: 2,
+		Tiles:  [][]byte{{0b1111_1111, 0b1100_0000}, {0b1000_0000, 0b0100_0000}},
+	}).ToBinary()
+	f.Add(valid)
+	f.Add(valid[:9])
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		layout, err := MapLayoutFromBinary(p)
+		if err != nil {
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("error is not a *DecodeError: %v", err)
+			}
+			return
+		}
+		if !bytes.Equal(layout.ToBinary(), p) {
+			t.Fatalf("layout does not re-encode to its input")
+		}
+	})
+}
+
+func FuzzPlayerSnapshotFromBinary(f *testing.F) {
+	valid := (&PlayerSnapshot{
+		IsLeader:            true,
+		Uuid:                "00000000-0000-0000-0000-000000000000",
+		Position:            Vector2[float64]{X: 1.8, Y: 1.8},
+		Velocity:            Vector2[float64]{X: 5, Y: 0},
+		SnapshotTimestampMs: 1756000000000,
+	}).ToBinary()
+	f.Add(valid)
+	f.Add(valid[:10])
+	f.Add(append(valid, 0))
+	f.Add([]byte{2})
+	f.Add([]byte{0, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		snapshot, err := PlayerSnapshotFromBinary(p)
+		if err != nil {
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("error is not a *DecodeError: %v", err)
+			}
+			return
+		}
+		if !bytes.Equal(snapshot.ToBinary(), p) {
+			t.Fatalf("snapshot does not re-encode to its input")
+		}
+	})
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		want error
+	}{
+		{"truncated length", []byte{0, 0}, ErrTruncated},
+		{"truncated string", []byte{0, 0, 0, 4, 'a'}, ErrTruncated},
+		{"string too long", []byte{0, 0, 0x10, 0, 'a'}, ErrStringTooLong},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := DecodeString(test.p); !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	if _, err := ParticleReleaseFromBinary(make([]byte, 41)); !errors.Is(err, ErrTrailingBytes) {
+		t.Fatalf("got %v, want %v", err, ErrTrailingBytes)
+	}
+	if _, err := PlayerSnapshotFromBinary([]byte{2}); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidValue)
+	}
+}
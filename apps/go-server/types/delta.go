@@ -0,0 +1,217 @@
+package types
+
+import (
+	"encoding/binary"
+)
+
+// Copy of a game's dynamic entities at one tick. Used as the baseline a
+// delta is encoded against.
+type StateSnapshot struct {
+	TickNumber uint64
+	Players    map[string]PlayerSnapshot
+	Particles  map[uint32]Particle
+}
+
+func (state *GameState) Capture() StateSnapshot {
+	snapshot := StateSnapshot{
+		TickNumber: state.TickNumber,
+		Players:    make(map[string]PlayerSnapshot, len(state.PlayerStates)),
+		Particles:  make(map[uint32]Particle, len(state.Particles)),
+	}
+	for _, player := range state.PlayerStates {
+		snapshot.Players[player.Uuid] = *player
+	}
+	for _, particle := range state.Particles {
+		snapshot.Particles[particle.Id] = *particle
+	}
+	return snapshot
+}
+
+// Whether a client holding the baseline player needs the current one.
+// The timestamp alone changing does not count.
+func playerChanged(baseline PlayerSnapshot, current *PlayerSnapshot) bool {
+	return baseline.IsLeader != current.IsLeader ||
+		baseline.Position != current.Position ||
+		baseline.Velocity != current.Velocity
+}
+
+// Everything a recipient needs to bring its copy of the game up to date.
+// Sent in the server's stateMessage, which each connection's Codec encodes.
+type StateUpdate struct {
+	TickNumber                 uint64 `json:"tick"`
+	LastProcessedInputSequence uint32 `json:"lastProcessedInputSequence"`
+	Kind                       uint8  `json:"kind"`
+	// Deltas only
+	BaselineTick uint64 `json:"baselineTick,omitempty"`
+
+	// Every player in a keyframe, new or changed ones in a delta
+	Players        []*PlayerSnapshot `json:"players"`
+	RemovedPlayers []string          `json:"removedPlayers,omitempty"`
+	// Every particle in a keyframe, new or changed ones in a delta
+	Particles        []*Particle `json:"particles"`
+	RemovedParticles []uint32    `json:"removedParticles,omitempty"`
+}
+
+// Changes since a baseline the recipient has acknowledged. Falls back to a
+// keyframe when there is no baseline.
+func (gameState *GameState) Update(recipientUuid string, baseline *StateSnapshot) StateUpdate {
+	update := StateUpdate{
+		TickNumber: gameState.TickNumber,
+		Kind:       SnapshotKeyframe,
+	}
+	if player := gameState.FindPlayer(recipientUuid); player != nil {
+		update.LastProcessedInputSequence = player.LastInputSequence
+	}
+	if baseline == nil {
+		update.Players = append([]*PlayerSnapshot{}, gameState.PlayerStates...)
+		update.Particles = append([]*Particle{}, gameState.Particles...)
+		return update
+	}
+	update.Kind = SnapshotDelta
+	update.BaselineTick = baseline.TickNumber
+
+	update.Players = []*PlayerSnapshot{}
+	present := make(map[string]bool, len(gameState.PlayerStates))
+	for _, player := range gameState.PlayerStates {
+		present[player.Uuid] = true
+		previous, existed := baseline.Players[player.Uuid]
+		if !existed || playerChanged(previous, player) {
+			update.Players = append(update.Players, player)
+		}
+	}
+	update.RemovedPlayers = []string{}
+	for uuid := range baseline.Players {
+		if !present[uuid] {
+			update.RemovedPlayers = append(update.RemovedPlayers, uuid)
+		}
+	}
+
+	update.Particles = []*Particle{}
+	presentParticles := make(map[uint32]bool, len(gameState.Particles))
+	for _, particle := range gameState.Particles {
+		presentParticles[particle.Id] = true
+		previous, existed := baseline.Particles[particle.Id]
+		if !existed || previous != *particle {
+			update.Particles = append(update.Particles, particle)
+		}
+	}
+	update.RemovedParticles = []uint32{}
+	for id := range baseline.Particles {
+		if !presentParticles[id] {
+			update.RemovedParticles = append(update.RemovedParticles, id)
+		}
+	}
+
+	return update
+}
+
+func (update *StateUpdate) AppendBinary(buffer []byte) []byte {
+	return update.appendTo(buffer, false)
+}
+
+// Same layout as AppendBinary, with players and particles quantized.
+func (update *StateUpdate) AppendQuantized(buffer []byte) []byte {
+	return update.appendTo(buffer, true)
+}
+
+// ENCODING (SnapshotKeyframe):
+// [
+// u64 serverTick;
+// u32 lastProcessedInputSequence;	of the recipient's player, 0 if none
+// u8 snapshotKind;	SnapshotKeyframe
+// u32 numPlayers;	PlayerSnapshot[];
+// u32 numParticles; Particle[]
+// ]
+//
+// ENCODING (SnapshotDelta):
+// [
+// u64 serverTick;
+// u32 lastProcessedInputSequence;	of the recipient's player, 0 if none
+// u8 snapshotKind;	SnapshotDelta
+// u64 baselineTick;
+// u32 numChangedPlayers;	PlayerSnapshot[];	new or changed since the baseline
+// u32 numRemovedPlayers;	(u32 uuidLength; string uuid)[];
+// u32 numChangedParticles;	Particle[];
+// u32 numRemovedParticles;	u32 id[];
+// ]
+//
+// Quantized updates use the quantized PlayerSnapshot and Particle encodings.
+func (update *StateUpdate) appendTo(buffer []byte, quantized bool) []byte {
+	buffer = binary.BigEndian.AppendUint64(buffer, update.TickNumber)
+	buffer = binary.BigEndian.AppendUint32(buffer, update.LastProcessedInputSequence)
+	buffer = append(buffer, update.Kind)
+	if update.Kind == SnapshotDelta {
+		buffer = binary.BigEndian.AppendUint64(buffer, update.BaselineTick)
+	}
+
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(update.Players)))
+	for _, player := range update.Players {
+		if quantized {
+			buffer = player.AppendQuantized(buffer)
+		} else {
+			buffer = player.AppendBinary(buffer)
+		}
+	}
+	if update.Kind == SnapshotDelta {
+		buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(update.RemovedPlayers)))
+		for _, uuid := range update.RemovedPlayers {
+			buffer = append(buffer, EncodeString(uuid)...)
+		}
+	}
+
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(update.Particles)))
+	for _, particle := range update.Particles {
+		if quantized {
+			buffer = particle.AppendQuantized(buffer)
+		} else {
+			buffer = particle.AppendBinary(buffer)
+		}
+	}
+	if update.Kind == SnapshotDelta {
+		buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(update.RemovedParticles)))
+		for _, id := range update.RemovedParticles {
+			buffer = binary.BigEndian.AppendUint32(buffer, id)
+		}
+	}
+
+	return buffer
+}
+
+// Fixed-size ring of recent snapshots, looked up by tick.
+type SnapshotHistory struct {
+	entries []StateSnapshot
+	next    int
+}
+
+func NewSnapshotHistory(capacity int) *SnapshotHistory {
+	return &SnapshotHistory{entries: make([]StateSnapshot, 0, capacity)}
+}
+
+// Overwrites the oldest snapshot once full.
+func (history *SnapshotHistory) Add(snapshot StateSnapshot) {
+	if len(history.entries) < cap(history.entries) {
+		history.entries = append(history.entries, snapshot)
+		return
+	}
+	history.entries[history.next] = snapshot
+	history.next = (history.next + 1) % len(history.entries)
+}
+
+// Returns: nil if the tick is too old or was never recorded
+func (history *SnapshotHistory) Get(tick uint64) *StateSnapshot {
+	for i := range history.entries {
+		if history.entries[i].TickNumber == tick {
+			return &history.entries[i]
+		}
+	}
+	return nil
+}
+
+// Tick of the newest snapshot. Returns false if there is none.
+func (history *SnapshotHistory) Latest() (uint64, bool) {
+	if len(history.entries) == 0 {
+		return 0, false
+	}
+	latest := (history.next + len(history.entries) - 1) % len(history.entries)
+	return history.entries[latest].TickNumber, true
+}
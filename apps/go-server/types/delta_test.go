@@ -0,0 +1,130 @@
+package types
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// Brings a client's copy of the game up to date the way a client would.
+func applyUpdate(baseline StateSnapshot, update StateUpdate) StateSnapshot {
+	result := StateSnapshot{
+		TickNumber: update.TickNumber,
+		Players:    map[string]PlayerSnapshot{},
+		Particles:  map[uint32]Particle{},
+	}
+	if update.Kind == SnapshotDelta {
+		maps.Copy(result.Players, baseline.Players)
+		maps.Copy(result.Particles, baseline.Particles)
+	}
+	for _, player := range update.Players {
+		result.Players[player.Uuid] = *player
+	}
+	for _, uuid := range update.RemovedPlayers {
+		delete(result.Players, uuid)
+	}
+	for _, particle := range update.Particles {
+		result.Particles[particle.Id] = *particle
+	}
+	for _, id := range update.RemovedParticles {
+		delete(result.Particles, id)
+	}
+	return result
+}
+
+// Only what a client can compare. Deltas leave out players whose timestamp
+// alone changed, and server-side fields are never sent.
+func asReceived(snapshot StateSnapshot) StateSnapshot {
+	for uuid, player := range snapshot.Players {
+		player.SnapshotTimestampMs = 0
+		player.InputKeys = 0
+		player.LastInputSequence = 0
+		snapshot.Players[uuid] = player
+	}
+	return snapshot
+}
+
+func TestDeltaMatchesKeyframe(t *testing.T) {
+	state := &GameState{TickNumber: 1}
+	for _, uuid := range []string{"a", "b", "c"} {
+		state.PlayerStates = append(state.PlayerStates, &PlayerSnapshot{Uuid: uuid, Position: Vector2[float64]{X: 2, Y: 2}})
+	}
+	for range 3 {
+		state.AddParticle(&Particle{Velocity: Vector2[float64]{X: 1}, TimeLeftMs: 1000})
+	}
+	history := NewSnapshotHistory(4)
+	history.Add(state.Capture())
+
+	state.TickNumber = 2
+	state.FindPlayer("a").SnapshotTimestampMs = 500
+	state.FindPlayer("a").LastInputSequence = 7
+	state.FindPlayer("b").Position.X = 3
+	state.PlayerStates = slices.DeleteFunc(state.PlayerStates, func(player *PlayerSnapshot) bool { return player.Uuid == "c" })
+	state.PlayerStates = append(state.PlayerStates, &PlayerSnapshot{Uuid: "d"})
+	state.Particles[0].TimeLeftMs = 950
+	state.Particles = slices.Delete(state.Particles, 1, 2)
+	state.AddParticle(&Particle{TimeLeftMs: 1000})
+
+	baseline := history.Get(1)
+	if baseline == nil {
+		t.Fatal("baseline not recorded")
+	}
+	delta := state.Update("a", baseline)
+	if delta.Kind != SnapshotDelta || delta.BaselineTick != 1 || delta.LastProcessedInputSequence != 7 {
+		t.Fatalf("delta header: kind %d, baseline %d, sequence %d", delta.Kind, delta.BaselineTick, delta.LastProcessedInputSequence)
+	}
+	changedPlayers := []string{}
+	for _, player := range delta.Players {
+		changedPlayers = append(changedPlayers, player.Uuid)
+	}
+	changedParticles := []uint32{}
+	for _, particle := range delta.Particles {
+		changedParticles = append(changedParticles, particle.Id)
+	}
+	slices.Sort(changedPlayers)
+	slices.Sort(changedParticles)
+	if !slices.Equal(changedPlayers, []string{"b", "d"}) || !slices.Equal(delta.RemovedPlayers, []string{"c"}) {
+		t.Errorf("players changed %v, removed %v; want changed [b d], removed [c]", changedPlayers, delta.RemovedPlayers)
+	}
+	if !slices.Equal(changedParticles, []uint32{1, 4}) || !slices.Equal(delta.RemovedParticles, []uint32{2}) {
+		t.Errorf("particles changed %v, removed %v; want changed [1 4], removed [2]", changedParticles, delta.RemovedParticles)
+	}
+
+	keyframe := state.Update("a", nil)
+	if keyframe.Kind != SnapshotKeyframe || len(keyframe.Players) != 3 || len(keyframe.Particles) != 3 {
+		t.Fatalf("keyframe: kind %d, %d players, %d particles", keyframe.Kind, len(keyframe.Players), len(keyframe.Particles))
+	}
+	fromDelta := asReceived(applyUpdate(*baseline, delta))
+	fromKeyframe := asReceived(applyUpdate(StateSnapshot{}, keyframe))
+	if !reflect.DeepEqual(fromDelta, fromKeyframe) {
+		t.Errorf("delta applied to its baseline:\n%+v\nkeyframe:\n%+v", fromDelta, fromKeyframe)
+	}
+	if !reflect.DeepEqual(fromKeyframe, asReceived(state.Capture())) {
+		t.Errorf("keyframe does not hold the current state")
+	}
+}
+
+func TestSnapshotHistory(t *testing.T) {
+	history := NewSnapshotHistory(3)
+	if _, exists := history.Latest(); exists {
+		t.Fatal("empty history has a latest snapshot")
+	}
+	for tick := uint64(1); tick <= 5; tick++ {
+		history.Add(StateSnapshot{TickNumber: tick})
+	}
+
+	for tick := uint64(1); tick <= 6; tick++ {
+		recorded := history.Get(tick)
+		kept := tick >= 3 && tick <= 5
+		if (recorded != nil) != kept {
+			t.Errorf("Get(%d) = %v, want recorded %v", tick, recorded, kept)
+		}
+		if recorded != nil && recorded.TickNumber != tick {
+			t.Errorf("Get(%d) returned tick %d", tick, recorded.TickNumber)
+		}
+	}
+	if latest, _ := history.Latest(); latest != 5 {
+		t.Errorf("Latest() = %d, want 5", latest)
+	}
+}
@@ -1,7 +1,6 @@
 package types
 
 import (
-	"encoding/binary"
 	"math"
 	"math/rand"
 )
@@ -13,40 +12,42 @@ type GameState struct {
 	PlayerStates []*PlayerSnapshot
 	Particles    []*Particle
 	MapLayout    MapLayout
+	TickNumber   uint64
+
+	nextParticleId uint32
 }
 
-// ENCODING:
-// [
-// u32 numPlayers;	PlayerSnapshot[];
-// u32 numParticles; Particle[]
-// MapLayout;
-// ]
-func (gameState *GameState) ToBinary() []byte {
-	buffer := []byte{}
+// Assigns the particle an id and adds it to the game.
+func (state *GameState) AddParticle(particle *Particle) {
+	state.nextParticleId++
+	particle.Id = state.nextParticleId
+	state.Particles = append(state.Particles, particle)
+}
 
-	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(gameState.PlayerStates)))
-	for _, playerState := range gameState.PlayerStates {
-		buffer = append(buffer, playerState.ToBinary()...)
-	}
+const SnapshotKeyframe uint8 = 0
+const SnapshotDelta uint8 = 1
 
-	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(gameState.Particles)))
-	for _, particle := range gameState.Particles {
-		buffer = append(buffer, particle.ToBinary()...)
+// Returns: nil if no player has the uuid
+func (state *GameState) FindPlayer(uuid string) *PlayerSnapshot {
+	for _, player := range state.PlayerStates {
+		if player.Uuid == uuid {
+			return player
+		}
 	}
-
-	buffer = append(buffer, gameState.MapLayout.ToBinary()...)
-
-	return buffer
+	return nil
 }
 
 func (state *GameState) Tick(durationMs float64) {
-	for _, state := range state.PlayerStates {
-		state.Tick(durationMs)
+	state.TickNumber++
+	for _, player := range state.PlayerStates {
+		player.Tick(durationMs, &state.MapLayout)
 	}
-	for particleIndex, particle := range state.Particles {
+	// Expired particles are filtered out in place
+	remainingParticles := state.Particles[:0]
+	for _, particle := range state.Particles {
 		particle.Tick(durationMs)
 		if particle.TimeLeftMs < 0 {
-			state.Particles = append(state.Particles[:particleIndex], state.Particles[particleIndex+1:]...)
+			continue
 		}
 		centerX := particle.Position.X
 		centerY := particle.Position.Y
@@ -119,5 +120,8 @@ func (state *GameState) Tick(durationMs float64) {
 
 		particle.Velocity.X = newVX
 		particle.Velocity.Y = newVY
+		remainingParticles = append(remainingParticles, particle)
 	}
+	clear(state.Particles[len(remainingParticles):])
+	state.Particles = remainingParticles
 }
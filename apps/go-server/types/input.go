@@ -0,0 +1,55 @@
+package types
+
+// Server-side movement speed, in tiles per second
+const PLAYER_SPEED_TILES_PER_SECOND = 5.0
+
+// Directional key bitmask sent by clients with each input
+const (
+	InputUp uint8 = 1 << iota
+	InputDown
+	InputLeft
+	InputRight
+)
+
+const InputAll = InputUp | InputDown | InputLeft | InputRight
+
+// Velocity in tiles per second for a set of pressed directional keys.
+// Opposite keys cancel out. Diagonals are not normalized, matching the client.
+func VelocityFromInput(keys uint8) Vector2[float64] {
+	velocity := Vector2[float64]{X: 0, Y: 0}
+	if keys&InputUp != 0 {
+		velocity.Y -= PLAYER_SPEED_TILES_PER_SECOND
+	}
+	if keys&InputDown != 0 {
+		velocity.Y += PLAYER_SPEED_TILES_PER_SECOND
+	}
+	if keys&InputLeft != 0 {
+		velocity.X -= PLAYER_SPEED_TILES_PER_SECOND
+	}
+	if keys&InputRight != 0 {
+		velocity.X += PLAYER_SPEED_TILES_PER_SECOND
+	}
+	return velocity
+}
+
+// Best guess at the keys behind a client-reported velocity.
+// Used for clients that still send whole PlayerSnapshots.
+func InputFromVelocity(velocity Vector2[float64]) uint8 {
+	keys := uint8(0)
+	if velocity.Y < 0 {
+		keys |= InputUp
+	} else if velocity.Y > 0 {
+		keys |= InputDown
+	}
+	if velocity.X < 0 {
+		keys |= InputLeft
+	} else if velocity.X > 0 {
+		keys |= InputRight
+	}
+	return keys
+}
+
+// Serial number comparison, so sequences keep working after wrapping around.
+func IsNewerSequence(sequence uint32, than uint32) bool {
+	return int32(sequence-than) > 0
+}
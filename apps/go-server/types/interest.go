@@ -0,0 +1,132 @@
+package types
+
+import "math"
+
+// Decides which entities a player is allowed to know about.
+type Interest struct {
+	// Farthest distance, in tiles, at which entities are visible. 0 means unlimited.
+	RadiusTiles float64
+	// Whether walls block vision
+	LineOfSight bool
+}
+
+func (interest Interest) Enabled() bool {
+	return interest.RadiusTiles > 0 || interest.LineOfSight
+}
+
+func (interest Interest) CanSee(layout *MapLayout, viewer Vector2[float64], target Vector2[float64]) bool {
+	if interest.RadiusTiles > 0 {
+		if math.Hypot(target.X-viewer.X, target.Y-viewer.Y) > interest.RadiusTiles {
+			return false
+		}
+	}
+	if interest.LineOfSight && !layout.HasLineOfSight(viewer, target) {
+		return false
+	}
+	return true
+}
+
+// Whether a straight line between two points crosses no wall tile.
+// The tiles containing the two points themselves are not checked.
+func (layout *MapLayout) HasLineOfSight(from Vector2[float64], to Vector2[float64]) bool {
+	x := int(math.Floor(from.X))
+	y := int(math.Floor(from.Y))
+	endX := int(math.Floor(to.X))
+	endY := int(math.Floor(to.Y))
+
+	dx := to.X - from.X
+	dy := to.Y - from.Y
+
+	// Grid traversal: step into whichever tile boundary the ray reaches first
+	stepX, tMaxX, tDeltaX := 0, math.Inf(1), math.Inf(1)
+	if dx > 0 {
+		stepX, tMaxX, tDeltaX = 1, (float64(x)+1-from.X)/dx, 1/dx
+	} else if dx < 0 {
+		stepX, tMaxX, tDeltaX = -1, (from.X-float64(x))/-dx, 1/-dx
+	}
+	stepY, tMaxY, tDeltaY := 0, math.Inf(1), math.Inf(1)
+	if dy > 0 {
+		stepY, tMaxY, tDeltaY = 1, (float64(y)+1-from.Y)/dy, 1/dy
+	} else if dy < 0 {
+		stepY, tMaxY, tDeltaY = -1, (from.Y-float64(y))/-dy, 1/-dy
+	}
+
+	steps := absInt(endX-x) + absInt(endY-y)
+	for i := 0; i < steps; i++ {
+		if tMaxX < tMaxY {
+			tMaxX += tDeltaX
+			x += stepX
+		} else {
+			tMaxY += tDeltaY
+			y += stepY
+		}
+		if x == endX && y == endY {
+			return true
+		}
+		if layout.IsWall(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Copy of the state holding only what the player with the uuid can see.
+// The player always sees itself. Without a player, nothing is visible.
+func (state *GameState) VisibleTo(uuid string, interest Interest) *GameState {
+	if !interest.Enabled() {
+		return state
+	}
+	visible := &GameState{
+		MapLayout:  state.MapLayout,
+		TickNumber: state.TickNumber,
+	}
+	viewer := state.FindPlayer(uuid)
+	if viewer == nil {
+		return visible
+	}
+	for _, player := range state.PlayerStates {
+		if player == viewer || interest.CanSee(&state.MapLayout, viewer.Position, player.Position) {
+			visible.PlayerStates = append(visible.PlayerStates, player)
+		}
+	}
+	for _, particle := range state.Particles {
+		if interest.CanSee(&state.MapLayout, viewer.Position, particle.Position) {
+			visible.Particles = append(visible.Particles, particle)
+		}
+	}
+	return visible
+}
+
+// Same as GameState.VisibleTo, for a recorded snapshot.
+func (snapshot *StateSnapshot) VisibleTo(uuid string, layout *MapLayout, interest Interest) *StateSnapshot {
+	if !interest.Enabled() {
+		return snapshot
+	}
+	visible := &StateSnapshot{
+		TickNumber: snapshot.TickNumber,
+		Players:    map[string]PlayerSnapshot{},
+		Particles:  map[uint32]Particle{},
+	}
+	viewer, exists := snapshot.Players[uuid]
+	if !exists {
+		return visible
+	}
+	for playerUuid, player := range snapshot.Players {
+		if playerUuid == uuid || interest.CanSee(layout, viewer.Position, player.Position) {
+			visible.Players[playerUuid] = player
+		}
+	}
+	for id, particle := range snapshot.Particles {
+		if interest.CanSee(layout, viewer.Position, particle.Position) {
+			visible.Particles[id] = particle
+		}
+	}
+	return visible
+}
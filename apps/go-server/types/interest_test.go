@@ -0,0 +1,148 @@
+package types
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// Layout from rows of '#' for walls and '.' for floor.
+func layoutFromRows(rows ...string) MapLayout {
+	layout := MapLayout{Width: uint32(len(rows[0])), Height: uint32(len(rows))}
+	for _, row := range rows {
+		packed := make([]byte, (len(row)+7)/8)
+		for x, tile := range row {
+			if tile == '#' {
+				packed[x/8] |= 0b1000_0000 >> (x % 8)
+			}
+		}
+		layout.Tiles = append(layout.Tiles, packed)
+	}
+	return layout
+}
+
+var interestLayout = layoutFromRows(
+	"########",
+	"#......#",
+	"#..#...#",
+	"#......#",
+	"########",
+)
+
+func TestHasLineOfSight(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to Vector2[float64]
+		want     bool
+	}{
+		{"same tile", Vector2[float64]{X: 1.2, Y: 1.2}, Vector2[float64]{X: 1.8, Y: 1.8}, true},
+		{"open row", Vector2[float64]{X: 1.5, Y: 1.5}, Vector2[float64]{X: 6.5, Y: 1.5}, true},
+		{"wall in between", Vector2[float64]{X: 1.5, Y: 2.5}, Vector2[float64]{X: 5.5, Y: 2.5}, false},
+		{"wall in between, reversed", Vector2[float64]{X: 5.5, Y: 2.5}, Vector2[float64]{X: 1.5, Y: 2.5}, false},
+		{"ending in a wall", Vector2[float64]{X: 1.5, Y: 2.5}, Vector2[float64]{X: 3.5, Y: 2.5}, true},
+		{"diagonal past the wall", Vector2[float64]{X: 1.5, Y: 1.5}, Vector2[float64]{X: 3.5, Y: 3.7}, true},
+		{"diagonal through the wall", Vector2[float64]{X: 2.5, Y: 1.5}, Vector2[float64]{X: 4.5, Y: 2.5}, false},
+		{"column around the wall", Vector2[float64]{X: 4.5, Y: 1.5}, Vector2[float64]{X: 4.5, Y: 3.5}, true},
+		{"column through the wall", Vector2[float64]{X: 3.5, Y: 1.5}, Vector2[float64]{X: 3.5, Y: 3.5}, false},
+		{"past the edge of the map", Vector2[float64]{X: 5.5, Y: 1.5}, Vector2[float64]{X: 9.5, Y: 1.5}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := interestLayout.HasLineOfSight(test.from, test.to); got != test.want {
+				t.Errorf("HasLineOfSight(%v, %v) = %v, want %v", test.from, test.to, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCanSeeRadius(t *testing.T) {
+	interest := Interest{RadiusTiles: 2}
+	viewer := Vector2[float64]{X: 1.5, Y: 1.5}
+	if !interest.CanSee(&interestLayout, viewer, Vector2[float64]{X: 3.4, Y: 1.5}) {
+		t.Error("target inside the radius is hidden")
+	}
+	if interest.CanSee(&interestLayout, viewer, Vector2[float64]{X: 5.5, Y: 1.5}) {
+		t.Error("target outside the radius is visible")
+	}
+	// Without line of sight, walls do not hide anything within the radius
+	if !interest.CanSee(&interestLayout, Vector2[float64]{X: 2.5, Y: 2.5}, Vector2[float64]{X: 4.4, Y: 2.5}) {
+		t.Error("target behind a wall is hidden without line of sight")
+	}
+	if (Interest{}).Enabled() {
+		t.Error("interest without a radius or line of sight is enabled")
+	}
+}
+
+// Viewer at (1.5, 2.5), left of the wall at (3, 2).
+func interestState() *GameState {
+	state := &GameState{MapLayout: interestLayout, TickNumber: 1}
+	state.PlayerStates = []*PlayerSnapshot{
+		{Uuid: "viewer", Position: Vector2[float64]{X: 1.5, Y: 2.5}},
+		{Uuid: "seen", Position: Vector2[float64]{X: 2.5, Y: 1.5}},
+		{Uuid: "hidden", Position: Vector2[float64]{X: 5.5, Y: 2.5}},
+		{Uuid: "far", Position: Vector2[float64]{X: 6.5, Y: 1.5}},
+	}
+	state.AddParticle(&Particle{Position: Vector2[float64]{X: 2.5, Y: 3.5}})
+	state.AddParticle(&Particle{Position: Vector2[float64]{X: 5.5, Y: 2.5}})
+	return state
+}
+
+func playerUuids(players []*PlayerSnapshot) []string {
+	uuids := []string{}
+	for _, player := range players {
+		uuids = append(uuids, player.Uuid)
+	}
+	slices.Sort(uuids)
+	return uuids
+}
+
+func TestVisibleTo(t *testing.T) {
+	interest := Interest{RadiusTiles: 4, LineOfSight: true}
+	state := interestState()
+
+	visible := state.VisibleTo("viewer", interest)
+	if uuids := playerUuids(visible.PlayerStates); !slices.Equal(uuids, []string{"seen", "viewer"}) {
+		t.Errorf("visible players %v, want [seen viewer]", uuids)
+	}
+	if len(visible.Particles) != 1 || visible.Particles[0].Id != 1 {
+		t.Errorf("visible particles %+v, want only particle 1", visible.Particles)
+	}
+
+	snapshot := state.Capture()
+	filtered := snapshot.VisibleTo("viewer", &state.MapLayout, interest)
+	if !slices.Equal(slices.Sorted(maps.Keys(filtered.Players)), []string{"seen", "viewer"}) || len(filtered.Particles) != 1 {
+		t.Errorf("recorded snapshot filtered differently: %+v", filtered)
+	}
+
+	if len(state.VisibleTo("unknown", interest).PlayerStates) != 0 || len(snapshot.VisibleTo("unknown", &state.MapLayout, interest).Players) != 0 {
+		t.Error("something is visible without a viewer")
+	}
+	if state.VisibleTo("viewer", Interest{}) != state {
+		t.Error("disabled interest filtered the state")
+	}
+}
+
+// Deltas are computed between filtered states, so players moving in and out
+// of view must appear and disappear like joins and leaves.
+func TestVisibleToDelta(t *testing.T) {
+	interest := Interest{LineOfSight: true}
+	state := interestState()
+	recorded := state.Capture()
+	baseline := recorded.VisibleTo("viewer", &state.MapLayout, interest)
+
+	state.TickNumber = 2
+	state.FindPlayer("hidden").Position = Vector2[float64]{X: 3.5, Y: 3.5}
+	update := state.VisibleTo("viewer", interest).Update("viewer", baseline)
+	if uuids := playerUuids(update.Players); !slices.Equal(uuids, []string{"hidden"}) || len(update.RemovedPlayers) != 0 {
+		t.Errorf("player coming into view: changed %v, removed %v", uuids, update.RemovedPlayers)
+	}
+
+	recorded = state.Capture()
+	baseline = recorded.VisibleTo("viewer", &state.MapLayout, interest)
+	state.TickNumber = 3
+	state.FindPlayer("hidden").Position = Vector2[float64]{X: 5.5, Y: 2.5}
+	update = state.VisibleTo("viewer", interest).Update("viewer", baseline)
+	if len(update.Players) != 0 || !slices.Equal(update.RemovedPlayers, []string{"hidden"}) {
+		t.Errorf("player going out of view: changed %v, removed %v", playerUuids(update.Players), update.RemovedPlayers)
+	}
+}
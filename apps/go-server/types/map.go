@@ -1,8 +1,8 @@
 package types
 
 import (
-	"bytes"
-	"encoding/binary"
+	"hash/crc32"
+	"math"
 )
 
 type MapLayout struct {
@@ -11,19 +11,30 @@ type MapLayout struct {
 	Tiles  [][]byte
 }
 
-// ENCODING:
-// [
-// u32 width;
-// u32 height;
-// flattened bitArray of map
-// ]
-func (layout *MapLayout) ToBinary() []byte {
-	buffer := []byte{}
-
-	buffer = binary.BigEndian.AppendUint32(buffer, layout.Width)
-	buffer = binary.BigEndian.AppendUint32(buffer, layout.Height)
+// Identifies a layout so clients can tell when the map has changed.
+func (layout *MapLayout) Version() uint32 {
+	return crc32.ChecksumIEEE(layout.ToBinary())
+}
 
-	buffer = append(buffer, bytes.Join(layout.Tiles, []byte{})...)
+// Tiles outside the layout count as walls.
+func (layout *MapLayout) IsWall(x int, y int) bool {
+	if x < 0 || y < 0 || x >= int(layout.Width) || y >= int(layout.Height) {
+		return true
+	}
+	if y >= len(layout.Tiles) || x/8 >= len(layout.Tiles[y]) {
+		return true
+	}
+	return (layout.Tiles[y][x/8]>>(7-x%8))&0b0000_0001 == 0b0000_0001
+}
 
-	return buffer
+// Whether any wall tile overlaps the rectangle [left, right) x [top, bottom).
+func (layout *MapLayout) OverlapsWall(left float64, top float64, right float64, bottom float64) bool {
+	for y := int(math.Floor(top)); y < int(math.Ceil(bottom)); y++ {
+		for x := int(math.Floor(left)); x < int(math.Ceil(right)); x++ {
+			if layout.IsWall(x, y) {
+				return true
+			}
+		}
+	}
+	return false
 }
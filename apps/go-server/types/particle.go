@@ -1,57 +1,69 @@
 package types
 
 import (
-	"encoding/binary"
+	"errors"
 	"math"
 )
 
-type Particle struct {
-	Position   Vector2[float64]
-	Velocity   Vector2[float64]
-	TimeLeftMs float64
-}
+// Fastest a released particle may travel. Must match PARTICLE_INITIAL_VELOCITY
+// in packages/client/src/core/renderer.ts, or every release gets slowed down.
+const PARTICLE_MAX_SPEED_TILES_PER_SECOND = 25.0
 
-func ParticleFromBinary(p []byte) Particle {
-	counter := 0
+// Longest a released particle may live. Must match PARTICLE_LIFETIME_MS in
+// packages/client/src/core/renderer.ts.
+const PARTICLE_MAX_LIFETIME_MS = 5000.0
 
-	posX := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
-	posY := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
+var ErrNonFiniteParticle = errors.New("particle release contains a non-finite value")
 
-	velX := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
-	velY := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
-
-	timeLeftMs := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
+type Particle struct {
+	// Assigned by GameState.AddParticle
+	Id         uint32           `json:"id"`
+	Position   Vector2[float64] `json:"position"`
+	Velocity   Vector2[float64] `json:"velocity"`
+	TimeLeftMs float64          `json:"timeLeftMs"`
 
-	return Particle{
-		Position: Vector2[float64]{
-			X: posX,
-			Y: posY,
-		},
-		Velocity: Vector2[float64]{
-			X: velX,
-			Y: velY,
-		},
-		TimeLeftMs: timeLeftMs,
-	}
+	// Server-side only
+	// Uuid of the player that released it
+	Owner string `json:"-"`
 }
 
-func (particle *Particle) ToBinary() []byte {
-	buffer := []byte{}
-
-	buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(particle.Position.X))
-	buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(particle.Position.Y))
-
-	buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(particle.Velocity.X))
-	buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(particle.Velocity.Y))
+// A particle released by a client, before the server assigns it an id.
+type ParticleRelease struct {
+	Position   Vector2[float64] `json:"position"`
+	Velocity   Vector2[float64] `json:"velocity"`
+	TimeLeftMs float64          `json:"timeLeftMs"`
+}
 
-	buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(particle.TimeLeftMs))
+// Rejects NaN and infinite values, which would poison every snapshot the
+// particle appears in.
+func (release *ParticleRelease) Validate() error {
+	for _, value := range []float64{
+		release.Position.X, release.Position.Y,
+		release.Velocity.X, release.Velocity.Y,
+		release.TimeLeftMs,
+	} {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return ErrNonFiniteParticle
+		}
+	}
+	return nil
+}
 
-	return buffer
+// The client's position is ignored; particles spawn at the owner's
+// authoritative position. Speed and lifetime are clamped to the server's
+// limits. The release should be validated first.
+func (release *ParticleRelease) ToParticle(owner string, position Vector2[float64]) Particle {
+	velocity := release.Velocity
+	if speed := math.Hypot(velocity.X, velocity.Y); speed > PARTICLE_MAX_SPEED_TILES_PER_SECOND {
+		velocity.X *= PARTICLE_MAX_SPEED_TILES_PER_SECOND / speed
+		velocity.Y *= PARTICLE_MAX_SPEED_TILES_PER_SECOND / speed
+	}
+	return Particle{
+		Position:   position,
+		Velocity:   velocity,
+		TimeLeftMs: min(max(release.TimeLeftMs, 0), PARTICLE_MAX_LIFETIME_MS),
+		Owner:      owner,
+	}
 }
 
 func (particle *Particle) Tick(durationMs float64) {
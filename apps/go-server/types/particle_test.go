@@ -0,0 +1,46 @@
+package types
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParticleRelease(t *testing.T) {
+	owner := Vector2[float64]{X: 3.5, Y: 7.5}
+	tests := []struct {
+		name    string
+		release ParticleRelease
+		invalid bool
+		speed   float64
+		timeMs  float64
+	}{
+		{"within limits", ParticleRelease{Velocity: Vector2[float64]{X: 3, Y: 4}, TimeLeftMs: 1000}, false, 5, 1000},
+		{"client release speed", ParticleRelease{Velocity: Vector2[float64]{X: 15, Y: -20}, TimeLeftMs: 5000}, false, 25, 5000},
+		{"too fast", ParticleRelease{Velocity: Vector2[float64]{X: 300, Y: 400}, TimeLeftMs: 1000}, false, PARTICLE_MAX_SPEED_TILES_PER_SECOND, 1000},
+		{"too long lived", ParticleRelease{TimeLeftMs: 1e12}, false, 0, PARTICLE_MAX_LIFETIME_MS},
+		{"negative lifetime", ParticleRelease{TimeLeftMs: -5}, false, 0, 0},
+		{"NaN velocity", ParticleRelease{Velocity: Vector2[float64]{X: math.NaN()}}, true, 0, 0},
+		{"infinite lifetime", ParticleRelease{TimeLeftMs: math.Inf(1)}, true, 0, 0},
+		{"infinite position", ParticleRelease{Position: Vector2[float64]{Y: math.Inf(-1)}}, true, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.release.Validate(); (err != nil) != test.invalid {
+				t.Fatalf("Validate() = %v, want invalid %v", err, test.invalid)
+			}
+			if test.invalid {
+				return
+			}
+			particle := test.release.ToParticle("owner", owner)
+			if particle.Position != owner || particle.Owner != "owner" {
+				t.Errorf("particle not spawned at its owner: %+v", particle)
+			}
+			if speed := math.Hypot(particle.Velocity.X, particle.Velocity.Y); math.Abs(speed-test.speed) > 1e-9 {
+				t.Errorf("speed = %v, want %v", speed, test.speed)
+			}
+			if particle.TimeLeftMs != test.timeMs {
+				t.Errorf("TimeLeftMs = %v, want %v", particle.TimeLeftMs, test.timeMs)
+			}
+		})
+	}
+}
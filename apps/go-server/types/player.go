@@ -1,102 +1,92 @@
 package types
 
 import (
-	"encoding/binary"
-	"log"
 	"math"
-	"runtime"
 	"time"
 )
 
+// Side length of a player's square bounding box, in tiles. Clients are sent it
+// with the map and use it for their own collisions.
+const PLAYER_SQUARE_LENGTH_TILES = 0.5
+
 type PlayerSnapshot struct {
-	IsLeader            bool
-	Uuid                string
-	Position            Vector2[float64]
-	Velocity            Vector2[float64]
-	SnapshotTimestampMs uint64
+	IsLeader            bool             `json:"isLeader"`
+	Uuid                string           `json:"uuid"`
+	Position            Vector2[float64] `json:"position"`
+	Velocity            Vector2[float64] `json:"velocity"`
+	SnapshotTimestampMs uint64           `json:"snapshotTimestampMs"`
+
+	// Server-side only
+	InputKeys         uint8  `json:"-"`
+	LastInputSequence uint32 `json:"-"`
 }
 
-// ENCODING:
-// [
-// bool isLeader 	1 byte;
-// u32 uuidLength; 	string uuid;
-// f64 position x; 	f64 position y;
-// f64 velocity x; 	f64 velocity y;
-// u64 serverTimestamp;
-// ]
-func (playerSnapshot *PlayerSnapshot) ToBinary() []byte {
-
-	var isLeaderByte byte
-	if playerSnapshot.IsLeader {
-		isLeaderByte = 1
-	} else {
-		isLeaderByte = 0
+// Applies a client input unless a newer one has already been applied.
+// Returns: whether the input was applied
+func (player *PlayerSnapshot) ApplyInput(sequence uint32, keys uint8) bool {
+	if player.LastInputSequence != 0 && !IsNewerSequence(sequence, player.LastInputSequence) {
+		return false
 	}
-
-	positionXBytes := math.Float64bits(playerSnapshot.Position.X)
-	positionYBytes := math.Float64bits(playerSnapshot.Position.Y)
-
-	velocityXBytes := math.Float64bits(playerSnapshot.Velocity.X)
-	velocityYBytes := math.Float64bits(playerSnapshot.Velocity.Y)
-
-	buffer := []byte{}
-
-	buffer = append(buffer, isLeaderByte)
-
-	buffer = append(buffer, EncodeString(playerSnapshot.Uuid)...)
-
-	buffer = binary.BigEndian.AppendUint64(buffer, positionXBytes)
-	buffer = binary.BigEndian.AppendUint64(buffer, positionYBytes)
-	buffer = binary.BigEndian.AppendUint64(buffer, velocityXBytes)
-	buffer = binary.BigEndian.AppendUint64(buffer, velocityYBytes)
-
-	buffer = binary.BigEndian.AppendUint64(buffer, playerSnapshot.SnapshotTimestampMs)
-
-	return buffer
+	player.LastInputSequence = sequence
+	player.InputKeys = keys & InputAll
+	return true
 }
 
-func PlayerSnapshotFromBinary(p []byte) (PlayerSnapshot, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			switch r := r.(type) {
-			case runtime.Error:
-				log.Print("Could not handle request properly. " + r.Error() + "\n")
-
-			}
-		}
-	}()
-	counter := uint32(0)
-
-	isLeader := p[counter] == 1
-	counter += 1
-
-	uuid, length := DecodeString(p[counter:])
-	counter += length
+func (player *PlayerSnapshot) Tick(durationMs float64, layout *MapLayout) {
+	player.Velocity = VelocityFromInput(player.InputKeys)
 
-	posX := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
-	posY := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
-
-	velX := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
-	velY := math.Float64frombits(binary.BigEndian.Uint64(p[counter : counter+8]))
-	counter += 8
+	// Each axis is resolved separately so players slide along walls
+	dx := player.Velocity.X * durationMs / 1000.0
+	dy := player.Velocity.Y * durationMs / 1000.0
+	steps := int(math.Ceil(math.Max(math.Abs(dx), math.Abs(dy)) / (PLAYER_SQUARE_LENGTH_TILES / 2.0)))
+	for step := 0; step < steps; step++ {
+		player.moveX(dx/float64(steps), layout)
+		player.moveY(dy/float64(steps), layout)
+	}
+	player.SnapshotTimestampMs = uint64(time.Now().UnixMilli())
+}
 
-	timestamp := binary.BigEndian.Uint64(p[counter : counter+8])
-	counter += 8
+// Left, top, right, bottom edges of the bounding box centered on (x, y)
+func playerBounds(x float64, y float64) (float64, float64, float64, float64) {
+	half := PLAYER_SQUARE_LENGTH_TILES / 2.0
+	return x - half, y - half, x + half, y + half
+}
 
-	return PlayerSnapshot{
-		IsLeader:            isLeader,
-		Uuid:                uuid,
-		Position:            Vector2[float64]{posX, posY},
-		Velocity:            Vector2[float64]{velX, velY},
-		SnapshotTimestampMs: timestamp,
-	}, nil
+func (player *PlayerSnapshot) moveX(dx float64, layout *MapLayout) {
+	if dx == 0 {
+		return
+	}
+	x := player.Position.X + dx
+	left, top, right, bottom := playerBounds(x, player.Position.Y)
+	if !layout.OverlapsWall(left, top, right, bottom) {
+		player.Position.X = x
+		return
+	}
+	// Stop flush against the wall that was hit
+	half := PLAYER_SQUARE_LENGTH_TILES / 2.0
+	if dx > 0 {
+		player.Position.X = math.Ceil(right) - 1 - half
+	} else {
+		player.Position.X = math.Floor(left) + 1 + half
+	}
+	player.Velocity.X = 0
 }
 
-func (player *PlayerSnapshot) Tick(durationMs float64) {
-	player.Position.X = player.Position.X + player.Velocity.X*durationMs/1000.0
-	player.Position.Y = player.Position.Y + player.Velocity.Y*durationMs/1000.0
-	player.SnapshotTimestampMs = uint64(time.Now().UnixMilli())
+func (player *PlayerSnapshot) moveY(dy float64, layout *MapLayout) {
+	if dy == 0 {
+		return
+	}
+	y := player.Position.Y + dy
+	left, top, right, bottom := playerBounds(player.Position.X, y)
+	if !layout.OverlapsWall(left, top, right, bottom) {
+		player.Position.Y = y
+		return
+	}
+	half := PLAYER_SQUARE_LENGTH_TILES / 2.0
+	if dy > 0 {
+		player.Position.Y = math.Ceil(bottom) - 1 - half
+	} else {
+		player.Position.Y = math.Floor(top) + 1 + half
+	}
+	player.Velocity.Y = 0
 }
@@ -0,0 +1,56 @@
+package types
+
+import (
+	"math"
+	"testing"
+)
+
+var movementLayout = layoutFromRows(
+	"######",
+	"#....#",
+	"#.#..#",
+	"#....#",
+	"######",
+)
+
+func TestPlayerTick(t *testing.T) {
+	tests := []struct {
+		name         string
+		start        Vector2[float64]
+		keys         uint8
+		durationMs   float64
+		wantPosition Vector2[float64]
+		wantVelocity Vector2[float64]
+	}{
+		{"standing still", Vector2[float64]{X: 1.5, Y: 1.5}, 0, 1000, Vector2[float64]{X: 1.5, Y: 1.5}, Vector2[float64]{}},
+		{"open floor", Vector2[float64]{X: 1.5, Y: 1.5}, InputRight, 100, Vector2[float64]{X: 2, Y: 1.5}, Vector2[float64]{X: 5}},
+		{"opposite keys", Vector2[float64]{X: 1.5, Y: 1.5}, InputLeft | InputRight, 100, Vector2[float64]{X: 1.5, Y: 1.5}, Vector2[float64]{}},
+		{"flush against the right wall", Vector2[float64]{X: 4, Y: 1.5}, InputRight, 1000, Vector2[float64]{X: 4.75, Y: 1.5}, Vector2[float64]{}},
+		{"flush against the left wall", Vector2[float64]{X: 1.5, Y: 1.5}, InputLeft, 1000, Vector2[float64]{X: 1.25, Y: 1.5}, Vector2[float64]{}},
+		{"flush against the ceiling", Vector2[float64]{X: 1.5, Y: 1.5}, InputUp, 1000, Vector2[float64]{X: 1.5, Y: 1.25}, Vector2[float64]{}},
+		{"flush against the floor", Vector2[float64]{X: 1.5, Y: 3.5}, InputDown, 1000, Vector2[float64]{X: 1.5, Y: 3.75}, Vector2[float64]{}},
+		{"flush against a wall tile", Vector2[float64]{X: 1.5, Y: 2.5}, InputRight, 1000, Vector2[float64]{X: 1.75, Y: 2.5}, Vector2[float64]{}},
+		{"sliding along the ceiling", Vector2[float64]{X: 3.5, Y: 1.5}, InputUp | InputRight, 200, Vector2[float64]{X: 4.5, Y: 1.25}, Vector2[float64]{X: 5}},
+		{"sliding along a wall tile", Vector2[float64]{X: 1.75, Y: 2.5}, InputDown | InputRight, 100, Vector2[float64]{X: 1.75, Y: 3}, Vector2[float64]{Y: 5}},
+		{"diagonally into a corner", Vector2[float64]{X: 4, Y: 3}, InputDown | InputRight, 1000, Vector2[float64]{X: 4.75, Y: 3.75}, Vector2[float64]{}},
+		{"up to a wall tile corner", Vector2[float64]{X: 1.5, Y: 1.5}, InputDown | InputRight, 50, Vector2[float64]{X: 1.75, Y: 1.75}, Vector2[float64]{X: 5, Y: 5}},
+		{"too far for one step", Vector2[float64]{X: 1.5, Y: 3.5}, InputRight, 10_000, Vector2[float64]{X: 4.75, Y: 3.5}, Vector2[float64]{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			player := PlayerSnapshot{Position: test.start, InputKeys: test.keys}
+			player.Tick(test.durationMs, &movementLayout)
+
+			if math.Abs(player.Position.X-test.wantPosition.X) > 1e-9 || math.Abs(player.Position.Y-test.wantPosition.Y) > 1e-9 {
+				t.Errorf("Position = %v, want %v", player.Position, test.wantPosition)
+			}
+			if player.Velocity != test.wantVelocity {
+				t.Errorf("Velocity = %v, want %v", player.Velocity, test.wantVelocity)
+			}
+			left, top, right, bottom := playerBounds(player.Position.X, player.Position.Y)
+			if movementLayout.OverlapsWall(left, top, right, bottom) {
+				t.Errorf("player ended up overlapping a wall at %v", player.Position)
+			}
+		})
+	}
+}
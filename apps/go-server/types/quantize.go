@@ -0,0 +1,28 @@
+package types
+
+import (
+	"math"
+)
+
+// Fixed point value for a quantized field, clamped to [0, 65535].
+// NaN is encoded as 0.
+func QuantizeUint16(value float64, scale float64) uint16 {
+	scaled := math.Round(value * scale)
+	if math.IsNaN(scaled) || scaled < 0 {
+		return 0
+	}
+	if scaled > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(scaled)
+}
+
+// Fixed point value for a quantized field, clamped to [-32768, 32767].
+// NaN is encoded as 0.
+func QuantizeInt16(value float64, scale float64) int16 {
+	scaled := math.Round(value * scale)
+	if math.IsNaN(scaled) {
+		return 0
+	}
+	return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, scaled)))
+}
@@ -0,0 +1,109 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Quantized values re-encode to themselves, so decoding and re-encoding any
+// input must be lossless.
+func FuzzQuantizedParticle(f *testing.F) {
+	particle := Particle{
+		Id:         7,
+		Position:   Vector2[float64]{X: 12.3, Y: 45.6},
+		Velocity:   Vector2[float64]{X: -3.25, Y: 4},
+		TimeLeftMs: 1500,
+	}
+	f.Add(particle.AppendQuantized([]byte{}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		decoder := NewDecoder(p)
+		decoded := DecodeQuantizedParticle(decoder)
+		if decoder.Finish() != nil {
+			return
+		}
+		if string(decoded.AppendQuantized([]byte{})) != string(p) {
+			t.Fatalf("quantized particle does not re-encode to its input")
+		}
+	})
+}
+
+func TestQuantizePrecision(t *testing.T) {
+	player := PlayerSnapshot{
+		Uuid:     "a",
+		Position: Vector2[float64]{X: 87.123456, Y: 3.999},
+		Velocity: Vector2[float64]{X: -PLAYER_SPEED_TILES_PER_SECOND, Y: 1.0 / 3.0},
+	}
+	decoder := NewDecoder(player.AppendQuantized([]byte{}))
+	decoded := DecodeQuantizedPlayerSnapshot(decoder)
+	if err := decoder.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range [][2]float64{
+		{player.Position.X, decoded.Position.X},
+		{player.Position.Y, decoded.Position.Y},
+		{player.Velocity.X, decoded.Velocity.X},
+		{player.Velocity.Y, decoded.Velocity.Y},
+	} {
+		if math.Abs(pair[0]-pair[1]) > 0.5/256 {
+			t.Errorf("%v decoded as %v", pair[0], pair[1])
+		}
+	}
+
+	if QuantizeUint16(-1, 256) != 0 || QuantizeUint16(1000, 256) != math.MaxUint16 || QuantizeUint16(math.NaN(), 256) != 0 {
+		t.Error("unsigned values are not clamped")
+	}
+	if QuantizeInt16(-1000, 256) != math.MinInt16 || QuantizeInt16(1000, 256) != math.MaxInt16 {
+		t.Error("signed values are not clamped")
+	}
+}
+
+// A busy room: every player moving and the air full of particles
+func benchmarkGameState(players int, particles int) *GameState {
+	state := &GameState{TickNumber: 1000}
+	for i := 0; i < players; i++ {
+		state.PlayerStates = append(state.PlayerStates, &PlayerSnapshot{
+			Uuid:                fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			Position:            Vector2[float64]{X: 1.8 + float64(i), Y: 40.25},
+			Velocity:            Vector2[float64]{X: PLAYER_SPEED_TILES_PER_SECOND, Y: 0},
+			SnapshotTimestampMs: 1_700_000_000_000,
+		})
+	}
+	for i := 0; i < particles; i++ {
+		state.AddParticle(&Particle{
+			Position:   Vector2[float64]{X: float64(i%32) + 0.37, Y: float64(i%90) + 0.61},
+			Velocity:   Vector2[float64]{X: 7.5, Y: -2.25},
+			TimeLeftMs: 3000,
+		})
+	}
+	return state
+}
+
+// Reports bytes per keyframe for each encoding. Compare with
+//
+//	go test -run=NONE -bench=StateUpdate ./types
+func BenchmarkStateUpdate(b *testing.B) {
+	for _, size := range []struct{ players, particles int }{{4, 0}, {8, 64}, {16, 256}} {
+		state := benchmarkGameState(size.players, size.particles)
+		update := state.Update("", nil)
+
+		for _, encoding := range []struct {
+			name   string
+			append func([]byte) []byte
+		}{
+			{"full", update.AppendBinary},
+			{"quantized", update.AppendQuantized},
+		} {
+			name := fmt.Sprintf("players=%d/particles=%d/%s", size.players, size.particles, encoding.name)
+			b.Run(name, func(b *testing.B) {
+				var encoded []byte
+				for b.Loop() {
+					encoded = encoding.append(encoded[:0])
+				}
+				b.ReportMetric(float64(len(encoded)), "bytes/snapshot")
+			})
+		}
+	}
+}
@@ -1,23 +1,34 @@
 import {
     TileType,
-    gameStateFromBinary,
-    composeUpdateMessageToServer,
+    InputKey,
+    ServerMessageType,
+    decodeServerMessage,
+    composeHelloMessage,
+    composeInputMessage,
     composeNewConnectionMessage,
     composeParticleReleasedMessage
 } from "@blind-maze/types";
 
 import type {
     GameSnapshot,
+    MapLayout,
     Player,
     PlayerSnapshot,
 } from "@blind-maze/types";
 
-import { DefaultRenderer, PARTICLE_INITIAL_VELOCITY, PARTICLE_LIFETIME_MS, PLAYER_SPEED, PLAYER_SQUARE_LENGTH_TILES, Renderer } from "./core/renderer.js"
+import { DefaultRenderer, PARTICLE_INITIAL_VELOCITY, PARTICLE_LIFETIME_MS, PLAYER_SPEED, Renderer } from "./core/renderer.js"
 import { DefaultInputHandler, InputHandler } from "./core/inputs.js"
 
 import WebSocketAsPromised from "websocket-as-promised";
 import "crypto";
 
+// An input sent to the server and how long it was applied for locally
+interface PendingInput {
+    sequence: number;
+    keys: number;
+    milliseconds: number;
+}
+
 // Appends itself to container
 export class GameClient {
     private renderer: Renderer;
@@ -28,7 +39,17 @@ export class GameClient {
     private host: string | null;
     private webSocketConnection: WebSocket | null;
     private lastGameSnapshot: GameSnapshot | null;
+    private map: MapLayout | null;
+    private mapVersion: number;
+    // Owned by the server, which sends it along with the map
+    private playerSquareLengthTiles: number;
     private lastThisPlayerSnapshot: PlayerSnapshot | null;
+    // Held directional keys as an InputKey bitmask
+    private inputKeys: number;
+    private inputSequence: number;
+    // Inputs the server has not acknowledged yet, replayed on top of each
+    // of its snapshots of this player
+    private pendingInputs: PendingInput[];
     private lastRenderMs: number;
     private updates: number;
 
@@ -45,33 +66,12 @@ export class GameClient {
             if (keysPressed.get("Escape") == true) {
                 this.renderer.exitFullScreenMode()
             }
-            if (this.lastThisPlayerSnapshot != null) {
-                let newVelocity = {
-                    x: 0,
-                    y: 0
-                };
-
-                if (keysPressed.get("ArrowUp")) newVelocity.y -= PLAYER_SPEED;
-                if (keysPressed.get("ArrowDown")) newVelocity.y += PLAYER_SPEED;
-                if (keysPressed.get("ArrowLeft")) newVelocity.x -= PLAYER_SPEED;
-                if (keysPressed.get("ArrowRight")) newVelocity.x += PLAYER_SPEED;
-
-
-                let updatedState: PlayerSnapshot = {
-                    uuid: this.lastThisPlayerSnapshot.uuid,
-                    isLeader: this.lastThisPlayerSnapshot.isLeader,
-                    position: {
-                        x: this.lastThisPlayerSnapshot.position.x,
-                        y: this.lastThisPlayerSnapshot.position.y
-                    },
-                    velocity: newVelocity,
-                    snapshotTimestampMs: Date.now()
-                }
-                this.lastThisPlayerSnapshot = updatedState;
-            }
-            else {
-                console.warn("Received input before receiving initial game state. Ignoring..")
-            }
+            let keys = 0
+            if (keysPressed.get("ArrowUp")) keys |= InputKey.Up;
+            if (keysPressed.get("ArrowDown")) keys |= InputKey.Down;
+            if (keysPressed.get("ArrowLeft")) keys |= InputKey.Left;
+            if (keysPressed.get("ArrowRight")) keys |= InputKey.Right;
+            this.inputKeys = keys
         })
 
         this.inputHandler.addMouseEventHandler((ev) => {
@@ -109,7 +109,13 @@ export class GameClient {
         this.host = null;
         this.webSocketConnection = null;
         this.lastGameSnapshot = null;
+        this.map = null;
+        this.mapVersion = 0;
+        this.playerSquareLengthTiles = 0;
         this.lastThisPlayerSnapshot = null;
+        this.inputKeys = 0;
+        this.inputSequence = 0;
+        this.pendingInputs = [];
         this.disposed = false
     }
 
@@ -129,8 +135,11 @@ export class GameClient {
         this.disposed = true;
     }
 
-    /**  On successful connection, starts rendering immediately. */
-    public async connectToServer(serverLocation: string): Promise<boolean> {
+    /**
+     * On successful connection, starts rendering immediately.
+     * accessToken is the Supabase session's, which the server requires outside of dev mode.
+     */
+    public async connectToServer(serverLocation: string, accessToken: string = ""): Promise<boolean> {
         let connection = new WebSocketAsPromised(serverLocation);
         await connection.open();
 
@@ -159,7 +168,37 @@ export class GameClient {
                         break;
                 }
 
-                let data = gameStateFromBinary(buffer!)
+                // No features are requested, so every state is an unquantized keyframe
+                let message = decodeServerMessage(buffer!, 0)
+                switch (message.type) {
+                    case ServerMessageType.Map:
+                        this.map = message.layout
+                        this.mapVersion = message.version
+                        this.playerSquareLengthTiles = message.playerSquareLengthTiles
+                        return
+                    case ServerMessageType.State:
+                        break;
+                    case ServerMessageType.Kicked:
+                    case ServerMessageType.ServerFull:
+                        console.warn("Disconnected by the server: " + message.reason)
+                        return
+                    case ServerMessageType.Error:
+                        console.warn(`Server error ${message.code}: ${message.reason}`)
+                        return
+                    default:
+                        return
+                }
+                if (this.map == null || message.state.mapVersion != this.mapVersion) {
+                    console.warn("Received game state before its map. Ignoring..")
+                    return
+                }
+
+                let data: GameSnapshot = {
+                    playerStates: message.state.players,
+                    particles: message.state.particles,
+                    map: this.map,
+                    playerSquareLengthTiles: this.playerSquareLengthTiles
+                }
 
                 if (!initialState) {
                     initialState = true;
@@ -170,7 +209,14 @@ export class GameClient {
                     this.thisPlayer.uuid === playerState.uuid
                 )
                 if (thisPlayerSnapshot != undefined) {
-                    this.lastThisPlayerSnapshot = thisPlayerSnapshot;
+                    // The server's snapshot already includes the inputs it has applied
+                    let lastProcessedInputSequence = message.state.lastProcessedInputSequence
+                    this.pendingInputs = this.pendingInputs.filter((input) => input.sequence > lastProcessedInputSequence)
+                    let predicted = thisPlayerSnapshot
+                    for (const input of this.pendingInputs) {
+                        predicted = this.predict(predicted, input.keys, input.milliseconds, data)
+                    }
+                    this.lastThisPlayerSnapshot = predicted;
                 }
                 else {
                     this.lastThisPlayerSnapshot = null
@@ -186,7 +232,8 @@ export class GameClient {
             this.host = serverLocation
             this.webSocketConnection = connection.ws
         }
-        let initialMessage: Uint8Array = composeNewConnectionMessage(this.thisPlayer.uuid)
+        connection.ws.send(composeHelloMessage(0))
+        let initialMessage: Uint8Array = composeNewConnectionMessage(this.thisPlayer.uuid, "", accessToken)
 
         connection.ws.send(initialMessage)
 
@@ -216,7 +263,9 @@ export class GameClient {
                 return
             }
             this.inputHandler.handleInputState()
-            this.tick(timeElapsed - this.lastRenderMs);
+            let milliseconds = timeElapsed - this.lastRenderMs
+            this.sendInput(this.webSocketConnection!, milliseconds)
+            this.lastThisPlayerSnapshot = this.predict(this.lastThisPlayerSnapshot, this.inputKeys, milliseconds, this.lastGameSnapshot)
             this.renderer.render(
                 this.lastGameSnapshot,
                 this.lastThisPlayerSnapshot.position.x,
@@ -224,44 +273,44 @@ export class GameClient {
             )
             this.lastRenderMs = timeElapsed;
             this.updates++;
-            await this.sendUpdateToServer(this.webSocketConnection!, this.lastThisPlayerSnapshot!)
         }
         requestAnimationFrame(this.renderUntilStopped.bind(this))
     }
 
 
-    private async sendUpdateToServer(server: WebSocket, updatedState: PlayerSnapshot): Promise<void> {
-        server.send(composeUpdateMessageToServer(updatedState));
+    // Sends the keys held this frame, one input per frame so each can be
+    // replayed for as long as it was applied
+    private sendInput(server: WebSocket, milliseconds: number) {
+        this.inputSequence++
+        this.pendingInputs.push({ sequence: this.inputSequence, keys: this.inputKeys, milliseconds: milliseconds })
+        server.send(composeInputMessage(this.inputSequence, this.inputKeys))
     }
 
-    // Main function for updating the game state
-    private tick(milliseconds: number) {
-        if (this.lastThisPlayerSnapshot == null) {
-            console.warn("Tried ticking without a player snaphot. Ignoring.")
-            return;
-        }
-
-        if (this.lastGameSnapshot == null) {
-            console.warn("Tried ticking before receiving an initial game snapshot. Ignoring.")
-            return;
-        }
-
-        let centerX = this.lastThisPlayerSnapshot!.position.x
-        let centerY = this.lastThisPlayerSnapshot!.position.y
+    // Where the player ends up after holding keys for a while, as the server
+    // would move it
+    private predict(snapshot: PlayerSnapshot, keys: number, milliseconds: number, game: GameSnapshot): PlayerSnapshot {
+        let centerX = snapshot.position.x
+        let centerY = snapshot.position.y
+        let playerSquareLengthTiles = game.playerSquareLengthTiles
 
-        let playerLeftX = centerX - PLAYER_SQUARE_LENGTH_TILES / 2.0
-        let playerRightX = centerX + PLAYER_SQUARE_LENGTH_TILES / 2.0
+        let playerLeftX = centerX - playerSquareLengthTiles / 2.0
+        let playerRightX = centerX + playerSquareLengthTiles / 2.0
 
-        let playerTopY = centerY - PLAYER_SQUARE_LENGTH_TILES / 2.0
-        let playerBottomY = centerY + PLAYER_SQUARE_LENGTH_TILES / 2.0
+        let playerTopY = centerY - playerSquareLengthTiles / 2.0
+        let playerBottomY = centerY + playerSquareLengthTiles / 2.0
 
-        let currentVX = this.lastThisPlayerSnapshot!.velocity.x
-        let currentVY = this.lastThisPlayerSnapshot!.velocity.y
+        // Diagonals are not normalized, matching the server
+        let currentVX = 0
+        let currentVY = 0
+        if (keys & InputKey.Up) currentVY -= PLAYER_SPEED;
+        if (keys & InputKey.Down) currentVY += PLAYER_SPEED;
+        if (keys & InputKey.Left) currentVX -= PLAYER_SPEED;
+        if (keys & InputKey.Right) currentVX += PLAYER_SPEED;
 
-        let newVX = this.lastThisPlayerSnapshot!.velocity.x
-        let newVY = this.lastThisPlayerSnapshot!.velocity.y
+        let newVX = currentVX
+        let newVY = currentVY
 
-        let tiles = this.lastGameSnapshot!.map.tiles;
+        let tiles = game.map.tiles;
 
 
         // Only check nearby tiles
@@ -309,12 +358,12 @@ export class GameClient {
             }
         }
 
-        let updatedState: PlayerSnapshot = {
-            isLeader: this.lastThisPlayerSnapshot!.isLeader,
-            uuid: this.lastThisPlayerSnapshot!.uuid,
+        return {
+            isLeader: snapshot.isLeader,
+            uuid: snapshot.uuid,
             position: {
-                x: this.lastThisPlayerSnapshot!.position.x + newVX * milliseconds / 1000.0,
-                y: this.lastThisPlayerSnapshot!.position.y + newVY * milliseconds / 1000.0
+                x: snapshot.position.x + newVX * milliseconds / 1000.0,
+                y: snapshot.position.y + newVY * milliseconds / 1000.0
             },
             velocity: {
                 x: newVX,
@@ -322,6 +371,5 @@ export class GameClient {
             },
             snapshotTimestampMs: Date.now()
         }
-        this.lastThisPlayerSnapshot = updatedState;
     }
 }
\ No newline at end of file
@@ -3,9 +3,10 @@ import { GameSnapshot, Player, PlayerSnapshot, TileType } from "@blind-maze/type
 export const PIXELS_PER_TILE = 50
 
 // Should be moved to global constants
-export const PLAYER_SQUARE_LENGTH_TILES = .5
 export const PARTICLE_SQUARE_LENGTH_TILES = 0.2
 export const PLAYER_SPEED = 5
+// Must match PARTICLE_MAX_SPEED_TILES_PER_SECOND and PARTICLE_MAX_LIFETIME_MS
+// in apps/go-server/types/particle.go, which cap what the server accepts
 export const PARTICLE_INITIAL_VELOCITY = 25
 export const PARTICLE_LIFETIME_MS = 5000
 export const CANVAS_ID = "home_main_game_canvas_id"
@@ -174,7 +175,7 @@ export class DefaultRenderer implements Renderer {
             context.arc(
                 this.viewPortWidthPx / 2 + (-centerX + playerX) * PIXELS_PER_TILE,
                 this.viewPortHeightPx / 2 + (-centerY + playerY) * PIXELS_PER_TILE,
-                PLAYER_SQUARE_LENGTH_TILES * PIXELS_PER_TILE / 2,
+                state.playerSquareLengthTiles * PIXELS_PER_TILE / 2,
                 0,
                 2 * Math.PI
             )
@@ -1,44 +1,57 @@
 import { describe, expect, test } from "@jest/globals"
 
 import type {
-    Player,
     PlayerSnapshot,
-    GameSnapshot,
-    MapLayout,
-    MapConfiguration,
+    ServerMessage,
 } from "./game_types"
 
 import {
     TileType,
-    gameStateFromBinary,
+    Feature,
+    PROTOCOL_VERSION,
+    ServerMessageType,
+    SnapshotKind,
+    decodeServerMessage,
+    InputKey,
+    composeHelloMessage,
+    composeInputMessage,
     composeUpdateMessageToServer,
     composeNewConnectionMessage,
-    encodeString
 } from "./game_types"
 
+import {
+    BinaryWriter,
+    encodeMapLayout,
+    encodeParticle,
+    encodePlayerSnapshot,
+    encodeQuantizedParticle,
+    encodeQuantizedPlayerSnapshot,
+} from "./codec.gen"
+
+function toArrayBuffer(bytes: Uint8Array): ArrayBuffer {
+    return bytes.buffer.slice(bytes.byteOffset, bytes.byteOffset + bytes.byteLength) as ArrayBuffer
+}
+
+const player: PlayerSnapshot = {
+    isLeader: false,
+    uuid: "\0",
+    position: { x: 1.5, y: 2.25 },
+    velocity: { x: -5, y: 0 },
+    snapshotTimestampMs: 1_000_000
+}
 
 // Counters are used for readability
 describe('game_types methods', () => {
     let decoder = new TextDecoder("UTF-8")
-    test("playerToBinary outputs correct result with all string fields", () => {
 
-        let result: Uint8Array = encodeString("00000000-0000-0000-0000-000000000000")
+    test("composeHelloMessage formulates binary message in correct format", () => {
+        let result = composeHelloMessage(Feature.DeltaSnapshots | Feature.Latency)
         let resultView = new DataView(result.buffer)
 
-        // Reference: https://planetcalc.com/9033/
-
-        let counter = 0;
-
-        let idLength = resultView.getUint32(counter);
-        expect(idLength).toBe(36)
-        counter += 4
-
-        let id = decoder.decode(result.subarray(counter, counter + 36))
-        expect(id).toBe("00000000-0000-0000-0000-000000000000")
-        counter += 36
-
-
-        expect(result.length).toBe(40)
+        expect(result[0]).toBe(5)
+        expect(resultView.getUint16(1)).toBe(PROTOCOL_VERSION)
+        expect(resultView.getUint32(3)).toBe(0b101)
+        expect(result.length).toBe(7)
     })
 
     test("composeNewConnectionMessage formulates binary message in correct format", () => {
@@ -61,20 +74,42 @@ describe('game_types methods', () => {
         expect(result.length).toBe(6)
     })
 
+    test("composeNewConnectionMessage carries an access token after an empty room id", () => {
+        let result: Uint8Array = composeNewConnectionMessage("\0", "", "token")
+        let resultView = new DataView(result.buffer)
+
+        expect(result[0]).toBe(0)
+
+        let counter = 1;
+
+        expect(resultView.getUint32(counter)).toBe(1)
+        counter += 4 + 1
+
+        expect(resultView.getUint32(counter)).toBe(0)
+        counter += 4
+
+        let tokenLength = resultView.getUint32(counter)
+        expect(tokenLength).toBe(5)
+        counter += 4
+
+        expect(decoder.decode(result.subarray(counter, counter + tokenLength))).toBe("token")
+        counter += tokenLength
+
+        expect(result.length).toBe(counter)
+    })
+
+    test("composeInputMessage formulates binary message in correct format", () => {
+        let result = composeInputMessage(300, InputKey.Up | InputKey.Right)
+        let resultView = new DataView(result.buffer)
+
+        expect(result[0]).toBe(3)
+        expect(resultView.getUint32(1)).toBe(300)
+        expect(result[5]).toBe(0b1001)
+        expect(result.length).toBe(6)
+    })
+
     test("composeUpdateMessageToServer formulates binary message in correct format", () => {
-        let message: Uint8Array = composeUpdateMessageToServer({
-            isLeader: false,
-            uuid: "\0",
-            position: {
-                x: 0,
-                y: 0
-            },
-            velocity: {
-                x: 0,
-                y: 0
-            },
-            snapshotTimestampMs: 1_000_000
-        })
+        let message: Uint8Array = composeUpdateMessageToServer(player)
 
         let messageView = new DataView(message.buffer);
 
@@ -92,119 +127,108 @@ describe('game_types methods', () => {
         expect(id).toBe("\0")
         counter += 1
 
-        let posX = messageView.getFloat64(counter);
-        expect(posX).toBeCloseTo(0, 1)
+        expect(messageView.getFloat64(counter)).toBe(1.5)
         counter += 8
-
-        let posY = messageView.getFloat64(counter);
-        expect(posY).toBeCloseTo(0, 1)
+        expect(messageView.getFloat64(counter)).toBe(2.25)
         counter += 8
-
-        let velX = messageView.getFloat64(counter);
-        expect(velX).toBeCloseTo(0, 1)
+        expect(messageView.getFloat64(counter)).toBe(-5)
         counter += 8
-
-        let velY = messageView.getFloat64(counter);
-        expect(velY).toBeCloseTo(0, 1)
+        expect(messageView.getFloat64(counter)).toBe(0)
         counter += 8
 
         let timestamp = messageView.getBigUint64(counter);
         expect(Number(timestamp)).toBe(1_000_000)
         counter += 8
 
-        expect(counter).toBe(47)
+        expect(counter).toBe(message.length)
     })
-    test("gameStateFromBinary parses correct barebones message correctly", () => {
-        let buffer: ArrayBuffer = new ArrayBuffer(60);
-        let bufferView = new DataView(buffer);
 
-        let counter = 0;
-
-        //numPlayers
-        bufferView.setUint32(counter, 1)
-        counter += 4
-
-        //isLeader
-        bufferView.setUint8(counter, 0)
-        counter += 1
-
-        //id
-        bufferView.setUint32(counter, 1)
-        counter += 4
-        bufferView.setUint8(counter, 0);
-        counter += 1
-
-        //pos
-        bufferView.setFloat64(counter, 0)
-        counter += 8
-        bufferView.setFloat64(counter, 0)
-        counter += 8
-
-        //vel
-        bufferView.setFloat64(counter, 0)
-        counter += 8
-        bufferView.setFloat64(counter, 0)
-        counter += 8
-
-        //timestamp
-        bufferView.setBigUint64(counter, BigInt(0))
-        counter += 8
-
-        //width
-        bufferView.setUint32(counter, 3)
-        counter += 4
-
-        //height
-        bufferView.setUint32(counter, 3)
-        counter += 4
-
-        //tiles
-        bufferView.setUint8(counter, 0b111_101_11)
-        counter += 1
-        bufferView.setUint8(counter, 0b1_0000000)
-        counter += 1
-
-        expect(counter).toBe(buffer.byteLength) // test check
-
-        let gameState: GameSnapshot = gameStateFromBinary(buffer)
-        expect(gameState.playerStates.length).toBe(1)
-
-        let playerState: PlayerSnapshot = gameState.playerStates[0]!
+    test("decodeServerMessage parses a keyframe", () => {
+        let writer = new BinaryWriter()
+        writer.u8(ServerMessageType.State)
+        writer.u32(9) // mapVersion
+        writer.u64(42) // tick
+        writer.u32(7) // lastProcessedInputSequence
+        writer.u8(SnapshotKind.Keyframe)
+        writer.u32(1)
+        encodePlayerSnapshot(writer, player)
+        writer.u32(1)
+        encodeParticle(writer, { id: 3, position: { x: 1, y: 1 }, velocity: { x: 25, y: 0 }, timeLeftMs: 5000 })
+
+        let message: ServerMessage = decodeServerMessage(toArrayBuffer(writer.finish()), 0)
+        if (message.type != ServerMessageType.State) throw new Error("expected a state message")
+
+        let state = message.state
+        expect(state.mapVersion).toBe(9)
+        expect(state.tick).toBe(42)
+        expect(state.lastProcessedInputSequence).toBe(7)
+        expect(state.kind).toBe(SnapshotKind.Keyframe)
+        expect(state.players).toEqual([player])
+        expect(state.removedPlayers).toEqual([])
+        expect(state.particles[0]!.id).toBe(3)
+        expect(state.particles[0]!.velocity.x).toBe(25)
+        expect(state.removedParticles).toEqual([])
+    })
 
-        expect(playerState.isLeader).toBe(false)
+    test("decodeServerMessage parses a quantized delta with latency", () => {
+        let writer = new BinaryWriter()
+        writer.u8(ServerMessageType.State)
+        writer.u16(35) // rttMs
+        writer.u32(9)
+        writer.u64(43)
+        writer.u32(0)
+        writer.u8(SnapshotKind.Delta)
+        writer.u64(42) // baselineTick
+        writer.u32(1)
+        encodeQuantizedPlayerSnapshot(writer, player)
+        writer.u32(1)
+        writer.string("gone")
+        writer.u32(1)
+        encodeQuantizedParticle(writer, { id: 4, position: { x: 2, y: 3 }, velocity: { x: 0, y: -25 }, timeLeftMs: 100 })
+        writer.u32(2)
+        writer.u32(1)
+        writer.u32(2)
+
+        let message = decodeServerMessage(toArrayBuffer(writer.finish()), Feature.QuantizedSnapshots | Feature.Latency)
+        if (message.type != ServerMessageType.State) throw new Error("expected a state message")
+
+        let state = message.state
+        expect(state.rttMs).toBe(35)
+        expect(state.mapVersion).toBe(9)
+        expect(state.kind).toBe(SnapshotKind.Delta)
+        expect(state.baselineTick).toBe(42)
+        expect(state.players[0]!.position).toEqual({ x: 1.5, y: 2.25 })
+        expect(state.removedPlayers).toEqual(["gone"])
+        expect(state.particles[0]!.timeLeftMs).toBe(100)
+        expect(state.removedParticles).toEqual([1, 2])
+    })
 
-        expect(playerState.uuid).toBe("\0")
+    test("decodeServerMessage parses a map message", () => {
+        let writer = new BinaryWriter()
+        writer.u8(ServerMessageType.Map)
+        writer.u32(1)
+        encodeMapLayout(writer, { width: 3, height: 3, tiles: [[1, 1, 1], [1, 0, 1], [1, 1, 1]] })
+        writer.f64(0.5)
 
-        expect(playerState.position.x).toBeCloseTo(0, 1)
-        expect(playerState.position.y).toBeCloseTo(0, 1)
-        expect(playerState.velocity.x).toBeCloseTo(0, 1)
-        expect(playerState.velocity.y).toBeCloseTo(0, 1)
+        let message = decodeServerMessage(toArrayBuffer(writer.finish()), 0)
+        if (message.type != ServerMessageType.Map) throw new Error("expected a map message")
 
-        expect(playerState.snapshotTimestampMs).toBe(0)
+        expect(message.version).toBe(1)
+        expect(message.playerSquareLengthTiles).toBe(0.5)
 
-        let map = gameState.map
+        let map = message.layout
         expect(map.width).toBe(3)
         expect(map.height).toBe(3)
+        expect(map.tiles[0]).toEqual([TileType.WALL, TileType.WALL, TileType.WALL])
+        expect(map.tiles[1]).toEqual([TileType.WALL, TileType.EMPTY, TileType.WALL])
+        expect(map.tiles[2]).toEqual([TileType.WALL, TileType.WALL, TileType.WALL])
+    })
+
+    test("decodeServerMessage rejects truncated messages", () => {
+        let writer = new BinaryWriter()
+        writer.u8(ServerMessageType.Welcome)
+        writer.u16(PROTOCOL_VERSION)
 
-        expect(map.tiles.length).toBe(3)
-
-        let row = map.tiles[0]!
-        expect(row!.length).toBe(3)
-        expect(row[0]).toBe(TileType.WALL)
-        expect(row[1]).toBe(TileType.WALL)
-        expect(row[2]).toBe(TileType.WALL)
-
-        row = map.tiles[1]!
-        expect(row!.length).toBe(3)
-        expect(row[0]).toBe(TileType.WALL)
-        expect(row[1]).toBe(TileType.EMPTY)
-        expect(row[2]).toBe(TileType.WALL)
-
-        row = map.tiles[2]!
-        expect(row!.length).toBe(3)
-        expect(row[0]).toBe(TileType.WALL)
-        expect(row[1]).toBe(TileType.WALL)
-        expect(row[2]).toBe(TileType.WALL)
+        expect(() => decodeServerMessage(toArrayBuffer(writer.finish()), 0)).toThrow(RangeError)
     })
 })
-
@@ -1,3 +1,25 @@
+import {
+    BinaryReader,
+    BinaryWriter,
+    decodeMapLayout,
+    decodeParticle,
+    decodePlayerSnapshot,
+    decodeQuantizedParticle,
+    decodeQuantizedPlayerSnapshot,
+    encodeParticleRelease,
+    encodePlayerSnapshot,
+} from "./codec.gen"
+
+import type {
+    MapLayout,
+    Particle,
+    ParticleRelease,
+    PlayerSnapshot,
+} from "./codec.gen"
+
+// Structs shared with the server are generated into codec.gen.ts from
+// apps/go-server/schema/codec.json. This file only frames them into messages.
+
 /**
  * Unique and persistent player identifier
  */
@@ -9,29 +31,6 @@ interface Player {
     color: string;
 }
 
-/**
- * Represents a player in the game at a specific moment in time.
- */
-interface PlayerSnapshot {
-    isLeader: boolean;
-    uuid: string;
-    position: { x: number; y: number };
-    velocity: { x: number; y: number };
-    snapshotTimestampMs: number;
-}
-
-interface Particle {
-    position: {
-        x: number;
-        y: number;
-    };
-    velocity: {
-        x: number;
-        y: number;
-    };
-    timeLeftMs: number;
-}
-
 /**
  * Represents the state of the game at a specific moment in time.
  */
@@ -39,6 +38,8 @@ interface GameSnapshot {
     playerStates: PlayerSnapshot[];
     particles: Particle[]
     map: MapLayout;
+    // Sent by the server along with the map
+    playerSquareLengthTiles: number;
 }
 
 enum TileType {
@@ -46,15 +47,6 @@ enum TileType {
     WALL,
 }
 
-/**
- * Represents an entire game map layout.
- */
-interface MapLayout {
-    width: number;
-    height: number;
-    tiles: TileType[][];
-}
-
 /**
  * Map initialization data.
  */
@@ -64,285 +56,283 @@ interface MapConfiguration {
     seed: string;
 }
 
+// Must match ProtocolVersion in apps/go-server/protocol.go
+const PROTOCOL_VERSION = 3
 
+// Feature flags a client can ask for in its hello
+enum Feature {
+    DeltaSnapshots = 1 << 0,
+    QuantizedSnapshots = 1 << 1,
+    Latency = 1 << 2,
+    SessionResume = 1 << 3,
+}
 
-// MapLayout ENCODING:
-// [
-// u32 width;
-// u32 height;
-// flattened bitArray of map
-// ]
-
-// PlayerSnapshot ENCODING:
-// [
-// bool isLeader 1 byte;
-// Player player;
-// f64 position x; 	f64 position y;
-// f64 velocity x; 	f64 velocity y;
-// u64 serverTimestamp;
-// ]
-
-// GameSnapshot ENCODING:
-// [
-// u32 numPlayers;	PlayerSnapshot[];
-// u32 numParticles; Particle[]
-// MapLayout(u32 width; u32 height; flattened bitArray of map);
-// ]
-
-function gameStateFromBinary(buffer: ArrayBufferLike): GameSnapshot {
-    let bufferView = new DataView(buffer)
-    let decoder = new TextDecoder("UTF-8")
-
-    let counter = 0
-
-    let numPlayers = bufferView.getUint32(counter)
-    counter += 4
+// Directional key bitmask sent with each input.
+// Must match the Input* constants in apps/go-server/types/input.go
+enum InputKey {
+    Up = 1 << 0,
+    Down = 1 << 1,
+    Left = 1 << 2,
+    Right = 1 << 3,
+}
 
-    let players: PlayerSnapshot[] = []
+enum ClientMessageType {
+    NewConnection = 0,
+    UpdateRequest = 1,
+    ReleaseParticle = 2,
+    Input = 3,
+    Ack = 4,
+    Hello = 5,
+    Resume = 6,
+    Spectate = 7,
+}
 
-    for (let i = 0; i < numPlayers; i++) {
-        let isLeader: boolean = Boolean(bufferView.getUint8(counter))
-        counter += 1
+enum ServerMessageType {
+    State = 0,
+    Map = 1,
+    Welcome = 2,
+    PlayerJoined = 3,
+    PlayerLeft = 4,
+    Kicked = 5,
+    Error = 6,
+    Session = 7,
+    ServerFull = 8,
+    Queued = 9,
+    Spectating = 10,
+}
 
-        let uuidLength = bufferView.getUint32(counter)
-        counter += 4
-        let uuid = decoder.decode(buffer.slice(counter, counter + uuidLength))
-        counter += uuidLength
+enum SnapshotKind {
+    Keyframe = 0,
+    Delta = 1,
+}
 
-        let positionX = bufferView.getFloat64(counter)
-        counter += 8
-        let positionY = bufferView.getFloat64(counter)
-        counter += 8
+/**
+ * A keyframe, or a delta against the snapshot at baselineTick.
+ */
+interface StateUpdate {
+    tick: number;
+    lastProcessedInputSequence: number;
+    kind: SnapshotKind;
+    baselineTick: number;
+    players: PlayerSnapshot[];
+    removedPlayers: string[];
+    particles: Particle[];
+    removedParticles: number[];
+    // Only with Feature.Latency
+    rttMs: number;
+    // Version of the map the state was simulated on
+    mapVersion: number;
+}
 
-        let velocityX = bufferView.getFloat64(counter)
-        counter += 8
-        let velocityY = bufferView.getFloat64(counter)
-        counter += 8
+type ServerMessage =
+    | { type: ServerMessageType.State, state: StateUpdate }
+    | { type: ServerMessageType.Map, version: number, layout: MapLayout, playerSquareLengthTiles: number }
+    | { type: ServerMessageType.Welcome, protocolVersion: number, features: number }
+    | { type: ServerMessageType.PlayerJoined | ServerMessageType.PlayerLeft, uuid: string }
+    | { type: ServerMessageType.Kicked | ServerMessageType.ServerFull, reason: string }
+    | { type: ServerMessageType.Error, code: number, reason: string }
+    | { type: ServerMessageType.Session, token: string, gracePeriodMs: number }
+    | { type: ServerMessageType.Queued, position: number }
+    | { type: ServerMessageType.Spectating, follow: string }
+
+// Decodes one binary message from the server.
+// features are the ones accepted in the server's welcome.
+function decodeServerMessage(buffer: ArrayBufferLike, features: number): ServerMessage {
+    let reader = new BinaryReader(buffer)
+    let type = reader.u8()
+
+    switch (type) {
+        case ServerMessageType.State:
+            return { type: ServerMessageType.State, state: decodeStateUpdate(reader, features) }
+        case ServerMessageType.Map:
+            return {
+                type: ServerMessageType.Map,
+                version: reader.u32(),
+                layout: decodeMapLayout(reader),
+                playerSquareLengthTiles: reader.f64(),
+            }
+        case ServerMessageType.Welcome:
+            return { type: ServerMessageType.Welcome, protocolVersion: reader.u16(), features: reader.u32() }
+        case ServerMessageType.PlayerJoined:
+            return { type: ServerMessageType.PlayerJoined, uuid: reader.string() }
+        case ServerMessageType.PlayerLeft:
+            return { type: ServerMessageType.PlayerLeft, uuid: reader.string() }
+        case ServerMessageType.Kicked:
+            return { type: ServerMessageType.Kicked, reason: reader.string() }
+        case ServerMessageType.ServerFull:
+            return { type: ServerMessageType.ServerFull, reason: reader.string() }
+        case ServerMessageType.Error:
+            return { type: ServerMessageType.Error, code: reader.u16(), reason: reader.string() }
+        case ServerMessageType.Session:
+            return { type: ServerMessageType.Session, token: reader.string(), gracePeriodMs: reader.u32() }
+        case ServerMessageType.Queued:
+            return { type: ServerMessageType.Queued, position: reader.u16() }
+        case ServerMessageType.Spectating:
+            return { type: ServerMessageType.Spectating, follow: reader.string() }
+        default:
+            throw new RangeError("unknown server message type " + type)
+    }
+}
 
-        let snapshotTimestampMs = bufferView.getBigUint64(counter)
-        counter += 8
+// ENCODING:
+// [
+// (Feature.Latency only) u16 rttMs;
+// u32 mapVersion;
+// u64 serverTick;
+// u32 lastProcessedInputSequence;
+// u8 snapshotKind;
+// (SnapshotKind.Delta only) u64 baselineTick;
+// u32 numPlayers;	PlayerSnapshot[];
+// (SnapshotKind.Delta only) u32 numRemovedPlayers;	(u32 uuidLength; string uuid)[];
+// u32 numParticles;	Particle[];
+// (SnapshotKind.Delta only) u32 numRemovedParticles;	u32 id[];
+// ]
+function decodeStateUpdate(reader: BinaryReader, features: number): StateUpdate {
+    let quantized = (features & Feature.QuantizedSnapshots) != 0
+    let rttMs = (features & Feature.Latency) != 0 ? reader.u16() : 0
+    let mapVersion = reader.u32()
 
-        let player = {
-            isLeader: isLeader,
-            uuid: uuid,
-            position: {
-                x: positionX,
-                y: positionY
-            },
-            velocity: {
-                x: velocityX,
-                y: velocityY
-            },
-            snapshotTimestampMs: Number(snapshotTimestampMs)
-        }
+    let tick = reader.u64()
+    let lastProcessedInputSequence = reader.u32()
+    let kind: SnapshotKind = reader.u8()
+    let delta = kind == SnapshotKind.Delta
+    let baselineTick = delta ? reader.u64() : 0
 
-        players.push(player)
+    let players: PlayerSnapshot[] = []
+    for (let i = reader.u32(); i > 0; i--) {
+        players.push(quantized ? decodeQuantizedPlayerSnapshot(reader) : decodePlayerSnapshot(reader))
+    }
+    let removedPlayers: string[] = []
+    for (let i = delta ? reader.u32() : 0; i > 0; i--) {
+        removedPlayers.push(reader.string())
     }
 
     let particles: Particle[] = []
-
-    let numParticles = bufferView.getUint32(counter)
-    counter += 4
-
-
-    for (let i = 0; i < numParticles; i++) {
-        let positionX = bufferView.getFloat64(counter)
-        counter += 8
-        let positionY = bufferView.getFloat64(counter)
-        counter += 8
-
-        let velocityX = bufferView.getFloat64(counter)
-        counter += 8
-        let velocityY = bufferView.getFloat64(counter)
-        counter += 8
-
-        let timeLeftMs = bufferView.getFloat64(counter)
-
-        counter += 8
-
-        particles.push({
-            position: {
-                x: positionX,
-                y: positionY
-            },
-            velocity: {
-                x: velocityX,
-                y: velocityY
-            },
-            timeLeftMs: timeLeftMs
-        })
+    for (let i = reader.u32(); i > 0; i--) {
+        particles.push(quantized ? decodeQuantizedParticle(reader) : decodeParticle(reader))
     }
-
-
-    let mapWidth = bufferView.getUint32(counter)
-    counter += 4
-    let mapHeight = bufferView.getUint32(counter)
-    counter += 4
-
-
-    let tiles: TileType[][] = []
-    let mapBytesLength: number = Math.ceil((1.0 * mapWidth * mapHeight) / 8.0)
-
-    let i = 0
-    let row: TileType[] = []
-    for (let k = 0; k < mapBytesLength; k++) {
-        let byte = bufferView.getUint8(counter)
-        counter += 1
-        for (let bitIndex = 7; bitIndex >= 0; bitIndex--) {
-            let digit = byte >> bitIndex & 0b0000_0001
-
-            row.push(digit)
-            i++
-            if ((i % mapWidth) == 0 && i != 0) {
-                tiles.push(row)
-                row = []
-            }
-            if (i >= mapHeight * mapWidth) {
-                break;
-            }
-
-        }
-        if (i >= mapHeight * mapWidth) {
-            break;
-        }
+    let removedParticles: number[] = []
+    for (let i = delta ? reader.u32() : 0; i > 0; i--) {
+        removedParticles.push(reader.u32())
     }
 
-
     return {
-        playerStates: players,
+        tick: tick,
+        lastProcessedInputSequence: lastProcessedInputSequence,
+        kind: kind,
+        baselineTick: baselineTick,
+        players: players,
+        removedPlayers: removedPlayers,
         particles: particles,
-        map: {
-            width: mapWidth,
-            height: mapHeight,
-            tiles: tiles
-        }
-    };
+        removedParticles: removedParticles,
+        rttMs: rttMs,
+        mapVersion: mapVersion,
+    }
 }
 
-
-// u32 len; string
-// likely inefficient to create an encoder each time
-function encodeString(s: string): Uint8Array {
-    let encoder = new TextEncoder()
-    let encoded = encoder.encode(s)
-    let result = new Uint8Array(encoded.length + 4)
-    let view = new DataView(result.buffer)
-    view.setUint32(0, encoded.length)
-    result.set(encoded, 4)
-    return result;
+// ENCODING:
+// [
+// u8 messageType;	ClientMessageType.Hello
+// u16 protocolVersion;
+// u32 requested feature flags;
+// ]
+function composeHelloMessage(features: number): Uint8Array {
+    let writer = new BinaryWriter()
+    writer.u8(ClientMessageType.Hello)
+    writer.u16(PROTOCOL_VERSION)
+    writer.u32(features)
+    return writer.finish()
 }
 
-function decodeString(bytes: Uint8Array): { value: string, bytesTraversed: number } {
-    let decoder = new TextDecoder("utf-8")
-    let dataView = new DataView(bytes.buffer)
-
-    let length = dataView.getUint32(0)
-    let decoded = decoder.decode(bytes.subarray(4, length + 4))
-    return {
-        value: decoded,
-        bytesTraversed: length
+// The server requires a Supabase access token outside of dev mode. An empty
+// roomId stays in the room the client connected to.
+//
+// ENCODING:
+// [
+// u8 messageType;	ClientMessageType.NewConnection
+// u32 uuidLength; string uuid;
+// (optional) u32 roomIdLength; string roomId;
+// (optional) u32 accessTokenLength; string accessToken;	needs roomId, which may be empty
+// ]
+function composeNewConnectionMessage(uuid: string, roomId: string = "", accessToken: string = ""): Uint8Array {
+    let writer = new BinaryWriter()
+    writer.u8(ClientMessageType.NewConnection)
+    writer.string(uuid)
+    if (roomId != "" || accessToken != "") {
+        writer.string(roomId)
+    }
+    if (accessToken != "") {
+        writer.string(accessToken)
     }
+    return writer.finish()
 }
 
+// The server acknowledges the newest input it has applied in each state's
+// lastProcessedInputSequence.
+//
 // ENCODING:
 // [
-// bool isLeader 1 byte;
-// Player player;
-// f64 position x; 	f64 position y;
-// f64 velocity x; 	f64 velocity y;
-// u64 serverTimestamp;
+// u8 messageType;	ClientMessageType.Input
+// u32 sequence;	starting at 1
+// u8 keys;	InputKey bitmask
 // ]
-function playerStateToBinary(state: PlayerSnapshot): Uint8Array {
-    let uuidBinary = encodeString(state.uuid)
-
-    let merged = new Uint8Array(
-        1 + uuidBinary.length + 40
-    )
-    merged[0] = Number(state.isLeader)
-    merged.set(uuidBinary, 1)
-    let counter = 1 + uuidBinary.length
-
-    let view = new DataView(merged.buffer)
-
-    view.setFloat64(counter, state.position.x)
-    counter += 8
-
-    view.setFloat64(counter, state.position.y)
-    counter += 8
-
-    view.setFloat64(counter, state.velocity.x)
-    counter += 8
-
-    view.setFloat64(counter, state.velocity.y)
-    counter += 8
-
-    view.setBigUint64(counter, BigInt(state.snapshotTimestampMs))
-    counter += 8
-
-    return merged
-}
-
-function composeParticleReleasedMessage(particle: Particle): Uint8Array {
-    let buffer = new ArrayBuffer(5 * 8 + 1)
-    let view = new DataView(buffer);
-    let arrayView = new Uint8Array(buffer)
-
-    let counter = 0
-
-    view.setUint8(counter, 2)
-    counter += 1
-
-    view.setFloat64(counter, particle.position.x)
-    counter += 8
-    view.setFloat64(counter, particle.position.y)
-    counter += 8
-
-    view.setFloat64(counter, particle.velocity.x)
-    counter += 8
-    view.setFloat64(counter, particle.velocity.y)
-    counter += 8
-
-    view.setFloat64(counter, particle.timeLeftMs)
-    counter += 8
-
-    return arrayView;
+function composeInputMessage(sequence: number, keys: number): Uint8Array {
+    let writer = new BinaryWriter()
+    writer.u8(ClientMessageType.Input)
+    writer.u32(sequence)
+    writer.u8(keys)
+    return writer.finish()
 }
 
+// ENCODING:
+// [
+// u8 messageType;	ClientMessageType.UpdateRequest
+// PlayerSnapshot;
+// ]
 function composeUpdateMessageToServer(state: PlayerSnapshot): Uint8Array {
-    let data = playerStateToBinary(state)
-    let merged = new Uint8Array(data.length + 1);
-
-    merged[0] = 1
-    merged.set(data, 1)
-
-    return merged
+    let writer = new BinaryWriter()
+    writer.u8(ClientMessageType.UpdateRequest)
+    encodePlayerSnapshot(writer, state)
+    return writer.finish()
 }
 
-function composeNewConnectionMessage(uuid: string): Uint8Array {
-    let playerEncoded: Uint8Array = encodeString(uuid)
-    let merged = new Uint8Array(playerEncoded.length + 1)
-
-    merged[0] = 0
-    merged.set(playerEncoded, 1)
-    return merged;
+// ENCODING:
+// [
+// u8 messageType;	ClientMessageType.ReleaseParticle
+// ParticleRelease;
+// ]
+function composeParticleReleasedMessage(particle: ParticleRelease): Uint8Array {
+    let writer = new BinaryWriter()
+    writer.u8(ClientMessageType.ReleaseParticle)
+    encodeParticleRelease(writer, particle)
+    return writer.finish()
 }
 
 
 export type {
     Player,
     PlayerSnapshot,
+    Particle,
+    ParticleRelease,
     GameSnapshot,
     MapLayout,
     MapConfiguration,
+    StateUpdate,
+    ServerMessage,
 }
 
 export {
     TileType,
-    gameStateFromBinary,
+    PROTOCOL_VERSION,
+    Feature,
+    InputKey,
+    ClientMessageType,
+    ServerMessageType,
+    SnapshotKind,
+    decodeServerMessage,
+    composeHelloMessage,
+    composeInputMessage,
     composeUpdateMessageToServer,
     composeParticleReleasedMessage,
     composeNewConnectionMessage,
-    encodeString,
-    decodeString
 }
-